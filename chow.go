@@ -1,11 +1,14 @@
 package chow
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 // Main runs the client application, and should be called immediately in main().
@@ -17,9 +20,95 @@ import (
 //             ...
 //         })
 //     }
+//
+// f holds the application's flags, and is parsed against the command-line arguments
+// before r is invoked.  It may be nil if the application has no flags.  The framework
+// registers its own flags, prefixed with "chow.", on f.  For example,
+// -chow.record=<file> writes the steps that would run to <file> without running them,
+// and -chow.dryrun logs them without running them.  Assertions about the files the steps
+// would produce are skipped in both cases, as are checks that a step's binary, directory
+// and stdin file exist.
+//
+// An error is returned if the flags cannot be parsed, or if the run fails.  It is a
+// *ChowError describing the failure.
+//
+// The first interrupt (e.g. Ctrl-C) is delivered to the running step as usual.  A second
+// interrupt cancels the run: the running step is killed, and any later steps are skipped.
+// Since the framework handles interrupts while it runs, a single interrupt no longer
+// stops the application itself; it only stops once its steps do.
 func Main(r Runnable, f *flag.FlagSet) error {
-	f.Parse(os.Args[1:])
-	return runRunnable(r, os.Stdout, os.Stderr)
+	return MainWith(r, f, MainOptions{})
+}
+
+// MainOptions configures where MainWith writes its output, and the arguments it parses.
+//
+// Args are the command-line arguments parsed against the application's flags.  When
+// nil, they are os.Args[1:].  This allows a program to run the application with
+// arguments of its choosing, such as when running it as a sub-command.
+//
+// Stdout and Stderr receive the output of each step's command, and default to os.Stdout
+// and os.Stderr.  StepLog receives the step logs, and defaults to Stdout.  If the run
+// used phases or log files, StepLog also receives the run summary after the last step
+// log, so that those may be read from the same stream.  The summary is otherwise only
+// returned by Run and written to the file given by the -chow.summary flag, if any, so
+// that a StepLog holds only step logs unless the run asks for more.  LogWriter, if set,
+// receives the step logs instead of StepLog, so that they may be captured or forwarded
+// without being parsed from JSON.
+//
+// Context, if set, cancels the run when it is done, as does a second interrupt.  Steps
+// that are running are killed, and later steps are skipped and return a StepResult with
+// CancelledExitCode.  The run then fails.
+type MainOptions struct {
+	Args      []string
+	Stdout    io.Writer
+	Stderr    io.Writer
+	StepLog   io.Writer
+	LogWriter LogWriter
+	Context   context.Context
+}
+
+// MainWith is like Main, but writes its output as configured by opts.  This allows the
+// framework to be embedded in a larger program that captures its output.
+func MainWith(r Runnable, f *flag.FlagSet, opts MainOptions) error {
+	return runMain(r, f, opts.args(), opts)
+}
+
+// Returns the command-line arguments to parse.
+func (o MainOptions) args() []string {
+	if o.Args == nil {
+		return os.Args[1:]
+	}
+	return o.Args
+}
+
+// Run is like MainWith, but returns the result of the run, so that the application may
+// exit with the status of the step that failed.
+//
+// Example Usage:
+//
+//     func main() {
+//         result := Run(RunSteps, nil, MainOptions{})
+//         if result.Err != nil {
+//             fmt.Fprint(os.Stderr, result.Err)
+//         }
+//         os.Exit(result.ExitCode)
+//     }
+func Run(r Runnable, f *flag.FlagSet, opts MainOptions) RunResult {
+	return mainResult(r, f, opts.args(), opts)
+}
+
+// RunResult describes the outcome of a run.
+//
+// ExitCode is 0 if the run succeeded, even if some steps exited with a non-zero code that
+// was tolerated.  If the run failed because a step exited with a non-zero code, it is
+// that step's exit code.  Otherwise it is 1, for example if a step's outputs were missing
+// or it timed out, or 2 if the flags could not be parsed.  Err is the error that stopped the run, if any, as returned by
+// Main.  Summary summarizes the steps that were run, including any that failed.  It is
+// also written to the file given by the -chow.summary flag, if any.
+type RunResult struct {
+	ExitCode int
+	Err      error
+	Summary  RunSummary
 }
 
 // Runner executes Steps.
@@ -34,27 +123,333 @@ func Main(r Runnable, f *flag.FlagSet) error {
 //     fmt.Println("Exit code:", result.ExitCode)
 type Runner interface {
 	Run(stepName string, s Step) StepResult
+
+	// RunWithStdin is like Run, but streams stdin to the step's command.  The step must
+	// not also set Step.Stdin.
+	//
+	// In tests, stdin is read in full and its contents are recorded in the step log.
+	RunWithStdin(stepName string, s Step, stdin io.Reader) StepResult
+
+	// TryRun is like Run, but returns an error instead of stopping the run if the step
+	// fails, such as when its binary cannot be found, it does not produce its outputs, or
+	// it sets Step.FailOnNonZeroExit and exits with a non-zero code.  In production the
+	// error is a *ChowError.
+	//
+	// In tests, a mocked non-zero exit of such a step is returned as an error rather than
+	// a warning.
+	TryRun(stepName string, s Step) (StepResult, error)
+
+	// RunAll runs each of steps in order, naming them "<prefix>_0", "<prefix>_1" and so
+	// on, and returns their results in the same order.
+	RunAll(prefix string, steps []Step) []StepResult
+
+	// RunParallel is like RunAll, but runs the steps concurrently, and returns once all
+	// of them have finished.  The steps must not depend on one another.  At most
+	// -chow.parallelism steps run at once, which defaults to the number of CPUs.  A value
+	// of 0 means there is no limit.
+	//
+	// In production, a fatal error in any step is raised once all steps have finished.
+	// Files declared as outputs by any of the steps are not counted against the others'
+	// ForbidOutputs or -chow.guard_start_dir, since it cannot be told which step produced
+	// them.  In tests, the steps are run in order, so that the expectation is deterministic.
+	RunParallel(prefix string, steps []Step) []StepResult
+
+	// Rename moves oldPath to newPath and records the move as a step.
+	//
+	// newPath is declared as an output of the step, so later steps may read from it.
+	// Both paths may use the framework's path syntax.
+	Rename(stepName, oldPath, newPath string)
+
+	// Phase groups the steps run by fn under a logical phase such as "fetch" or "build".
+	//
+	// Step names inside the phase are prefixed with the phase name, e.g. "build/compile".
+	// The total duration of the phase's steps is recorded in the run summary.
+	Phase(name string, fn func(Runner))
+
+	// Group returns a Runner that prefixes the names of all steps it runs with name and
+	// a slash, e.g. "build/compile", so that sub-recipes may be run without their step
+	// names colliding.  Groups nest, so a group "cc" of the group "build" names its steps
+	// "build/cc/<step>".  Unlike Phase, a group is not recorded in the run summary.
+	Group(name string) Runner
+
+	// AssertExists asserts that path exists, and records the assertion as a step named
+	// "assert_exists".
+	//
+	// In production it is a fatal error if the path does not exist.  In tests, a warning
+	// is issued if the path was not declared as an output of any previous step.
+	AssertExists(path string)
+
+	// AssertExistsRelative asserts that the path rel, relative to base, exists, and
+	// records the assertion like AssertExists, with the joined path.
+	//
+	// base may be any path understood by the framework, such as the start dir, the
+	// current working directory, or an output of a previous step.  In production it is
+	// a fatal error if the path does not exist.  In tests, a warning is issued if the
+	// path was not declared as an output of any previous step.
+	AssertExistsRelative(base, rel string)
+
+	// AssertOutputOrder asserts that the given paths were produced in order.
+	//
+	// In production, it is a fatal error if any path does not exist or was last modified
+	// before the path preceding it.  In tests, a warning is issued if any path was not
+	// declared as an output, or was declared before the path preceding it.
+	AssertOutputOrder(paths ...string)
+
+	// ListDir returns the sorted names of the entries in the directory at path.
+	//
+	// In production the directory is read from disk, and it is a fatal error if it
+	// cannot be read.  In tests, the entries are the paths inside the directory that
+	// were declared as outputs by previous steps or created by mocks.
+	ListDir(path string) []string
+
+	// Stat describes the file at path, and reports whether it exists, so that recipes
+	// may branch on the state of the filesystem.
+	//
+	// In production the file is read from disk, and it is a fatal error if it cannot be
+	// read for any reason other than not existing.  In tests, a path exists if it was
+	// declared as an output by a previous step or created by a mock, and is a directory
+	// if any such path is inside it.  Its size is that of the contents given by mocks,
+	// if any, and its mode is not known.
+	Stat(path string) (FileInfoLite, bool)
+
+	// ReadFile returns the contents of the file at path, without running a step, for
+	// reading small files such as version strings.
+	//
+	// In production the file is read from disk.  In tests, the contents are those given
+	// for the path by a mock, or those of the placeholder at path, and it is an error if
+	// there are none.
+	ReadFile(path string) ([]byte, error)
+
+	// WriteFile writes data to the file at path, without running a step, and records the
+	// write as a step named "write_file" with path as its output, so that later steps and
+	// assertions may use it.
+	//
+	// In production it is a fatal error if the file cannot be written.  In tests, the
+	// file is not written, but its contents may be read by ReadFile.  A warning is issued
+	// for an absolute path, since it would not be portable; use a framework path such as
+	// "//out/VERSION" instead.
+	WriteFile(path string, data []byte)
+
+	// PlaceholderContents returns the current contents of the placeholder ref, which may
+	// be a placeholder returned by Placeholder or its ID.
+	//
+	// In tests, contents produced by mocked steps take precedence over the contents of the
+	// placeholder's backing file.
+	PlaceholderContents(ref string) []byte
+
+	// Chdir changes the current working directory, against which PathCwd paths are
+	// resolved, to path.
+	//
+	// In production the process's working directory is changed, and it is a fatal error
+	// if this fails.  In tests, the working directory is only simulated, and path must
+	// be relative, or rooted at the start dir or current working directory.
+	Chdir(path string)
+
+	// Platform returns the operating system steps run on, using the same values as
+	// runtime.GOOS.  Tests may spoof this with TestCase.Platform.
+	Platform() string
+
+	// Properties unmarshals the application's properties, which configure a run, into
+	// dst, which should be a pointer to a struct.  Fields of dst without a property keep
+	// their values.
+	//
+	// In production, the properties are given as a JSON object by the -chow.properties
+	// flag.  In tests, they are given by TestCase.Properties.  It is a fatal error if the
+	// properties cannot be unmarshaled into dst, for example because of an unknown field.
+	Properties(dst interface{})
+}
+
+// FileInfoLite describes a file, as returned by Runner.Stat.
+//
+// Unlike os.FileInfo, it omits details such as modification times that would make
+// expectations depend on the machine they were generated on.
+type FileInfoLite struct {
+	Name  string      `json:"name"`
+	Size  int64       `json:"size"`
+	Mode  os.FileMode `json:"mode,omitempty"`
+	IsDir bool        `json:"is_dir,omitempty"`
 }
 
 // Runnable is the client application. This should be passed to Main().
 type Runnable func(Runner)
 
+// Compose returns a Runnable that invokes each of runnables in order against the same
+// Runner.  This allows recipes to be built from libraries of reusable sub-recipes.
+//
+// Step names are not namespaced by Compose.  A step that reuses the name of an earlier
+// step is run as a repeated invocation, e.g. "build 1", so sub-recipes should prefix
+// their step names, such as "lint/build", or accept a prefix from their callers.
+func Compose(runnables ...Runnable) Runnable {
+	return func(r Runner) {
+		for _, runnable := range runnables {
+			runnable(r)
+		}
+	}
+}
+
 // Step describes a shell command to run.
 //
 // Outputs is an optional list of paths that will exist after Command is run. In
 // production, it is a fatal error if any of the paths do not exist after the
 // step is run.  In tests, warnings are issued if a client attempts to read from
-// a path that was not declared by any previous step.
+// a path that was not declared by any previous step.  An output may be a glob
+// pattern, as understood by filepath.Match, in which case it must match at least one
+// path.  An output may also be a placeholder, in which case its backing file must exist.
+// If RequireNonEmptyOutputs is set, every output file must also be non-empty.
+//
+// ForbidOutputs is an optional list of paths the step must not create or modify.  In
+// production, it is a fatal error if any of them were created or modified by the step.
+//
+// Env holds optional environment variables for Command.  They are added to the
+// environment inherited from the current process, overriding any inherited variables
+// with the same names.  Paths in the values are converted like paths in Command.
+//
+// If ExpandEnv is set, references to environment variables in Command, written $VAR or
+// ${VAR}, are replaced by their values in the step's environment, as understood by
+// os.Expand.  Undefined variables expand to the empty string.  Variables are expanded
+// before paths are converted, so a variable may hold a path such as "//out".  Expansion
+// is opt-in so that arguments are otherwise passed through verbatim, unlike in a shell.
+// In tests, the process's environment is stubbed by TestCase.Env.
+//
+// Dir is an optional working directory for Command.  If empty, Command runs in the
+// current working directory.  Paths are converted like paths in Command, and it is a
+// fatal error in production if the directory does not exist.
+//
+// Stdin is optional input for Command.  It may be a placeholder, in which case the
+// placeholder's contents are used.
+//
+// Timeout is an optional limit on how long Command may run before it is killed.  If
+// zero, the default timeout given by the -chow.timeout flag is used, if any.  In
+// production, a step that times out is logged with TimeoutExitCode and then causes a
+// fatal error.  Timeouts are recorded, but not enforced, in tests.
+//
+// Retries is the number of times Command is run again after an attempt that exits with
+// a non-zero code or times out.  Timeout applies to each attempt, and TotalTimeout, if
+// set, bounds all of them together.  Once TotalTimeout has elapsed, the running attempt
+// is killed and no more are made.  Only the last attempt is logged, with the number of
+// attempts made and, if it timed out, which limit killed it.  Retries are recorded, but
+// not performed, in tests.
+//
+// A step that exits with a non-zero code is logged like any other, and its exit code is
+// left to the caller to check.  If FailOnNonZeroExit is set, the step instead causes a
+// fatal error once it is logged.  In tests, a warning is issued instead.  Outputs are
+// only required of steps that exit successfully, so a tolerated failure need not produce
+// them.  In tests, the outputs of a failed step are not considered to exist.
+//
+// If RemoveOutputsOnFailure is set and the step exits with a non-zero code, any outputs
+// the step created are removed, so that partially-written outputs are not mistaken for
+// valid ones by later runs.  Outputs that existed before the step are kept, as is
+// everything that existed inside them, so that no data from before the step is lost.
+//
+// LogFiles optionally labels files the step's command writes its logs to, such as
+// {"build": "//out/build.log"}, so that they may be linked to from the step.  Paths are
+// converted like paths in Command, and are listed in the run summary.  In production, a
+// warning is issued for any log file that does not exist after the step.
+//
+// If Combined is set, the command's stdout and stderr are recorded together, in the
+// order they were written, in StepResult.Combined instead of separately.  Both are
+// streamed to the console's stdout.
+//
+// StreamOutputTo is an optional file, such as a placeholder, that the command's stdout,
+// or its combined output if Combined is set, is written to in full.  Only the last
+// StreamedOutputTail bytes are then recorded in the StepResult, so that commands which
+// produce large logs are not held in memory.  Paths are converted like paths in Command,
+// and the converted path is recorded in the step log.  The file is not written in tests.
+//
+// MaxOutputBytes optionally caps the number of bytes of each of the command's output
+// streams recorded in the StepResult.  Output past the cap is still streamed to the
+// console, but is dropped from the result and replaced by a marker such as
+// "...[truncated 42 bytes]".  Zero means no cap.  It does not apply to output streamed
+// to a file by StreamOutputTo, whose tail is recorded instead.  In tests, the outputs of
+// mocked results are truncated in the same way.
+//
+// Optional fields are omitted from step logs and expectations when empty.
 type Step struct {
-	Command []string `json:"command"`
-	Outputs []string `json:"outputs"`
+	Command []string          `json:"command" yaml:"command"`
+	Outputs []string          `json:"outputs,omitempty" yaml:"outputs,omitempty"`
+	Env     map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Dir     string            `json:"dir,omitempty" yaml:"dir,omitempty"`
+	Stdin   string            `json:"stdin,omitempty" yaml:"stdin,omitempty"`
+	Timeout time.Duration     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Retries int               `json:"retries,omitempty" yaml:"retries,omitempty"`
+
+	RequireNonEmptyOutputs bool              `json:"require_non_empty_outputs,omitempty" yaml:"require_non_empty_outputs,omitempty"`
+	ForbidOutputs          []string          `json:"forbid_outputs,omitempty" yaml:"forbid_outputs,omitempty"`
+	FailOnNonZeroExit      bool              `json:"fail_on_non_zero_exit,omitempty" yaml:"fail_on_non_zero_exit,omitempty"`
+	Combined               bool              `json:"combined,omitempty" yaml:"combined,omitempty"`
+	RemoveOutputsOnFailure bool              `json:"remove_outputs_on_failure,omitempty" yaml:"remove_outputs_on_failure,omitempty"`
+	LogFiles               map[string]string `json:"log_files,omitempty" yaml:"log_files,omitempty"`
+	StreamOutputTo         string            `json:"stream_output_to,omitempty" yaml:"stream_output_to,omitempty"`
+	MaxOutputBytes         int               `json:"max_output_bytes,omitempty" yaml:"max_output_bytes,omitempty"`
+	ExpandEnv              bool              `json:"expand_env,omitempty" yaml:"expand_env,omitempty"`
+	TotalTimeout           time.Duration     `json:"total_timeout,omitempty" yaml:"total_timeout,omitempty"`
 }
 
+// StreamedOutputTail is the number of bytes of a step's output recorded in its
+// StepResult when the output is streamed to a file by Step.StreamOutputTo.
+const StreamedOutputTail = 64 * 1024
+
+// TimeoutExitCode is the exit code recorded for a step that was killed because it
+// exceeded its timeout.
+const TimeoutExitCode = -1000
+
+// CancelledExitCode is the exit code recorded for a step that was killed, or skipped,
+// because the run was cancelled.
+const CancelledExitCode = -1001
+
 // StepResult describes the output of a step execution.
+//
+// Combined holds the interleaved stdout and stderr of a step run with Step.Combined.
+// Outputs holds structured results of the step, such as the contents of the files it
+// produced, by path.  It is only set by mocks, and is verified against expectations.  In
+// tests, files within the working directory are written to disk for the duration of the
+// test.
+//
+// Duration is how long the step's command ran.  In tests, it is zero unless given by a
+// mock, so that expectations are deterministic; a mocked duration is recorded in the
+// step log and counted towards the phase and run summaries.
+//
+// Empty output is omitted from step logs and expectations.  ExitCode is always present.
 type StepResult struct {
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
-	ExitCode int    `json:"exit_code"`
+	Stdout   string            `json:"stdout,omitempty" yaml:"stdout,omitempty"`
+	Stderr   string            `json:"stderr,omitempty" yaml:"stderr,omitempty"`
+	Combined string            `json:"combined,omitempty" yaml:"combined,omitempty"`
+	ExitCode int               `json:"exit_code" yaml:"exit_code"`
+	Duration time.Duration     `json:"duration,omitempty" yaml:"duration,omitempty"`
+	Outputs  map[string]string `json:"outputs,omitempty" yaml:"outputs,omitempty"`
+}
+
+// StepLog describes a step invocation.
+//
+// This is logged to the console in production and serialized into an
+// expectation file when testing.
+//
+// Env is the environment the step's command received, with secrets redacted.  It is
+// only recorded when requested.  Stdin describes the input streamed to the step's
+// command, if any.  In production this is only a marker, since the input may be large;
+// in tests it is the input itself.  OutputDigests holds the hex-encoded sha256 digest
+// of each output file, by path, and is only recorded when requested.  OutputModes holds
+// the mode of each output, by path.  In production, it is only recorded when requested
+// with -chow.record_output_modes.  In tests, modes are given by mocks.  OutputTimes
+// holds the modification time of each output, by path.  It is only recorded in
+// production when requested with -chow.record_output_times, and never in tests, since
+// it is not deterministic.
+//
+// Attempts is the number of times the step's command was run, and is only recorded in
+// production for steps with Step.Retries set.  TimeoutLimit names the limit that killed
+// a step that timed out: "timeout" for Step.Timeout, or "total_timeout" for
+// Step.TotalTimeout.
+type StepLog struct {
+	StepName      string                 `json:"step_name" yaml:"step_name"`
+	Step          Step                   `json:"step" yaml:"step"`
+	StepResult    StepResult             `json:"result" yaml:"result"`
+	Env           map[string]string      `json:"env,omitempty" yaml:"env,omitempty"`
+	Stdin         string                 `json:"stdin,omitempty" yaml:"stdin,omitempty"`
+	OutputDigests map[string]string      `json:"output_digests,omitempty" yaml:"output_digests,omitempty"`
+	OutputModes   map[string]os.FileMode `json:"output_modes,omitempty" yaml:"output_modes,omitempty"`
+	OutputTimes   map[string]time.Time   `json:"output_times,omitempty" yaml:"output_times,omitempty"`
+	Attempts      int                    `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	TimeoutLimit  string                 `json:"timeout_limit,omitempty" yaml:"timeout_limit,omitempty"`
 }
 
 // Placeholder returns a unique ID that serves as a "placeholder" for a file.
@@ -68,30 +463,96 @@ type StepResult struct {
 // To read or write to a placeholder directly - for example, using
 // ioutil.WriteFile or ioutil.ReadFile - you must first call PlaceholderPath to
 // resolve the ID to its underlying filepath.
+//
+// Placeholder is safe for concurrent use.  Its backing file is removed when Main returns.
+// In tests, placeholders created by the application are removed when TestConfig.Run
+// returns, and IDs are numbered from the same point on every run of a test case, so that
+// expectations do not depend on the order in which tests run.  Placeholders created
+// before the run, such as in test setup, are kept.
 func Placeholder(contents string) string {
-	if placeholders == nil {
-		placeholders = make(map[string]io.WriteCloser)
-	}
+	return PlaceholderBytes([]byte(contents))
+}
 
-	id := fmt.Sprintf("%d", len(placeholders))
+// PlaceholderBytes is like Placeholder, but writes raw bytes, which need not be valid
+// UTF-8.
+func PlaceholderBytes(contents []byte) string {
+	id := fmt.Sprintf("%d", atomic.AddInt64(&placeholderCount, 1)-1)
 	tempFile, err := ioutil.TempFile("", id)
 	if err != nil {
-		panic(err)
+		logFatal("failed to create placeholder", err, Step{})
+	}
+
+	defer tempFile.Close()
+	if _, err = tempFile.Write(contents); err != nil {
+		logFatal("failed to write placeholder", err, Step{})
 	}
 
-	if _, err = tempFile.Write([]byte(contents)); err != nil {
-		panic(err)
+	placeholdersMu.Lock()
+	placeholders[id] = tempFile.Name()
+	placeholdersMu.Unlock()
+	return PathPlaceholder + id
+}
+
+// DirectoryPlaceholder is like Placeholder, but creates an empty directory rather than a
+// file.  This is useful for steps whose tools write to an output directory.
+//
+// DirectoryPlaceholder is safe for concurrent use.  Its backing directory and everything
+// in it is removed when Main returns.
+func DirectoryPlaceholder() string {
+	id := fmt.Sprintf("%d", atomic.AddInt64(&placeholderCount, 1)-1)
+	dir, err := ioutil.TempDir("", id)
+	if err != nil {
+		logFatal("failed to create placeholder", err, Step{})
 	}
 
-	placeholders[id] = tempFile
-	return "//ph/" + id
+	placeholdersMu.Lock()
+	placeholders[id] = dir
+	placeholdersMu.Unlock()
+	return PathPlaceholder + id
 }
 
-// PlaceholderPath returns the filepath represented by the given placeholder ID.
+// PlaceholderPath returns the file or directory path represented by the given
+// placeholder ID.
 func PlaceholderPath(id string) string {
-	tempFile, ok := placeholders[id].(*os.File)
-	if !ok {
-		panic(fmt.Errorf("unkown placeholder ID: %v", id))
+	path, err := lookupPlaceholder(id)
+	if err != nil {
+		logFatal("unknown placeholder", err, Step{})
+	}
+	return path
+}
+
+// ReadPlaceholder returns the current contents of the backing file of the placeholder
+// ref, which may be a placeholder returned by Placeholder or its ID.
+//
+// This is useful for reading the output of a step that wrote to a placeholder.  An error
+// is returned if ref is not a known placeholder, or its backing file cannot be read.
+func ReadPlaceholder(ref string) (string, error) {
+	contents, err := ReadPlaceholderBytes(ref)
+	return string(contents), err
+}
+
+// ReadPlaceholderBytes is like ReadPlaceholder, but returns the raw bytes of the
+// placeholder's contents.
+func ReadPlaceholderBytes(ref string) ([]byte, error) {
+	path, err := lookupPlaceholder(placeholderID(ref))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// ResetPlaceholders removes the backing files and directories of all placeholders, and
+// forgets them.
+//
+// This is called automatically when Main returns.  Tests may call it to start each case
+// with a clean slate, in which case placeholder IDs are reused.
+func ResetPlaceholders() {
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+
+	for _, path := range placeholders {
+		os.RemoveAll(path)
 	}
-	return tempFile.Name()
+	placeholders = make(map[string]string)
+	atomic.StoreInt64(&placeholderCount, 0)
 }
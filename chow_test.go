@@ -2,25 +2,34 @@ package chow
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 )
 
 // TODO: Add tests for path conversion in outputs.
-// TODO: Add tests for when there are mutliple matching mocks
 func TestProdRunner_Run(t *testing.T) {
 	// Expects that executing the given step produces the given step log.  Results in a
 	// test failure if the actual log differs.
-	expectOutput := func(t *testing.T, step Step, expected stepLog) {
+	expectOutput := func(t *testing.T, step Step, expected StepLog) {
 		stderr := new(bytes.Buffer)
 		startDir, _ := os.Getwd()
 
@@ -35,7 +44,7 @@ func TestProdRunner_Run(t *testing.T) {
 		runner.Run("", step)
 
 		// Deserialize step output
-		var actual stepLog
+		var actual StepLog
 		if err := json.NewDecoder(&stepOutput).Decode(&actual); err != nil {
 			t.Fatalf("failed to decode step Output: %v: %v", stepOutput, err)
 		}
@@ -50,7 +59,7 @@ func TestProdRunner_Run(t *testing.T) {
 			for _, step := range steps {
 				r.Run("", step)
 			}
-		}, os.Stdout, os.Stderr) == nil {
+		}, os.Stdout, os.Stderr, options{}) == nil {
 			t.Fatalf("expected an error. got nil")
 		}
 	}
@@ -58,11 +67,23 @@ func TestProdRunner_Run(t *testing.T) {
 	// Test setup.
 	echoPath := buildTestBinary(t, "echo")
 	catPath := buildTestBinary(t, "cat")
+	sleepPath := buildTestBinary(t, "sleep")
+	exitPath := buildTestBinary(t, "exit")
+	killPath := buildTestBinary(t, "kill")
+	touchPath := buildTestBinary(t, "touch")
+	interleavePath := buildTestBinary(t, "interleave")
+	linesPath := buildTestBinary(t, "lines")
 
 	// Test teardown.
 	defer func() {
 		os.RemoveAll(echoPath)
 		os.RemoveAll(catPath)
+		os.RemoveAll(sleepPath)
+		os.RemoveAll(exitPath)
+		os.RemoveAll(killPath)
+		os.RemoveAll(touchPath)
+		os.RemoveAll(interleavePath)
+		os.RemoveAll(linesPath)
 	}()
 
 	t.Run("should run a command", func(t *testing.T) {
@@ -70,7 +91,7 @@ func TestProdRunner_Run(t *testing.T) {
 			Command: []string{echoPath, "Hello, World!"},
 		}
 
-		output := stepLog{
+		output := StepLog{
 			Step: Step{
 				Command: []string{echoPath, "Hello, World!"},
 			},
@@ -87,10 +108,10 @@ func TestProdRunner_Run(t *testing.T) {
 		expectedPath := filepath.FromSlash(startDir + "/path/to/file")
 
 		input := Step{
-			Command: []string{echoPath, "///path/to/file"},
+			Command: []string{echoPath, "//path/to/file"},
 		}
 
-		output := stepLog{
+		output := StepLog{
 			Step: Step{
 				Command: []string{echoPath, expectedPath},
 			},
@@ -107,10 +128,10 @@ func TestProdRunner_Run(t *testing.T) {
 		expectedPath := filepath.FromSlash(cwd + "/path/to/file")
 
 		input := Step{
-			Command: []string{echoPath, "//cwd/path/to/file"},
+			Command: []string{echoPath, "//CWD/path/to/file"},
 		}
 
-		output := stepLog{
+		output := StepLog{
 			Step: Step{
 				Command: []string{echoPath, expectedPath},
 			},
@@ -126,13 +147,13 @@ func TestProdRunner_Run(t *testing.T) {
 	t.Run("should convert placeholders", func(t *testing.T) {
 		placeholder := Placeholder("def")
 		placeholderID := strings.SplitN(placeholder, "//ph/", 2)[1]
-		placeholderBackingFile := placeholders[placeholderID].(*os.File).Name()
+		placeholderBackingFile := placeholders[placeholderID]
 
 		input := Step{
 			Command: []string{catPath, placeholder},
 		}
 
-		output := stepLog{
+		output := StepLog{
 			Step: Step{
 				Command: []string{catPath, placeholderBackingFile},
 			},
@@ -149,7 +170,7 @@ func TestProdRunner_Run(t *testing.T) {
 			Command: []string{echoPath, "/absolute/path"},
 		}
 
-		output := stepLog{
+		output := StepLog{
 			Step: Step{
 				Command: []string{echoPath, "/absolute/path"},
 			},
@@ -168,99 +189,3886 @@ func TestProdRunner_Run(t *testing.T) {
 		}})
 	})
 
-	t.Run("should error if a binary does not exist", func(t *testing.T) {
+	t.Run("should accept a placeholder output", func(t *testing.T) {
+		placeholder := Placeholder("contents")
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{Command: []string{"./" + echoPath}, Outputs: []string{placeholder}})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should accept a directory placeholder output", func(t *testing.T) {
+		dir := DirectoryPlaceholder()
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{Command: []string{"./" + echoPath}, Outputs: []string{dir}})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should error if a placeholder output is missing", func(t *testing.T) {
+		placeholder := Placeholder("contents")
+		if err := os.Remove(PlaceholderPath(placeholderID(placeholder))); err != nil {
+			t.Fatal(err)
+		}
+
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{Command: []string{"./" + echoPath}, Outputs: []string{placeholder}})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err == nil || !strings.Contains(err.Error(), "outputs missing") {
+			t.Errorf("expected a missing output error. Got %v", err)
+		}
+	})
+
+	t.Run("should accept a glob matching non-empty outputs", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		ioutil.WriteFile("testdata_out/a.txt", []byte("a"), 0644)
+		ioutil.WriteFile("testdata_out/b.txt", []byte("b"), 0644)
+
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command:                []string{echoPath},
+				Outputs:                []string{"//CWD/testdata_out/*.txt"},
+				RequireNonEmptyOutputs: true,
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should error if a glob matches only empty outputs", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		ioutil.WriteFile("testdata_out/a.txt", nil, 0644)
+
 		expectError(t, []Step{{
-			Command: []string{"i_dont_exist"},
+			Command:                []string{echoPath},
+			Outputs:                []string{"//CWD/testdata_out/*.txt"},
+			RequireNonEmptyOutputs: true,
+		}})
+	})
+
+	t.Run("should error if a glob matches no outputs", func(t *testing.T) {
+		expectError(t, []Step{{
+			Command: []string{echoPath},
+			Outputs: []string{"//CWD/missing/*.txt"},
+		}})
+	})
+
+	t.Run("should run a command in a relative dir", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		ioutil.WriteFile("testdata_out/file.txt", []byte("relative"), 0644)
+
+		absCatPath, _ := filepath.Abs(catPath)
+		input := Step{
+			Command: []string{absCatPath, "file.txt"},
+			Dir:     "testdata_out",
+		}
+
+		output := StepLog{
+			Step: Step{
+				Command: []string{absCatPath, "file.txt"},
+				Dir:     "testdata_out",
+			},
+			StepResult: StepResult{
+				Stdout: "relative",
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should convert a start dir rooted dir", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		ioutil.WriteFile("testdata_out/file.txt", []byte("rooted"), 0644)
+
+		startDir, _ := os.Getwd()
+		absCatPath, _ := filepath.Abs(catPath)
+		input := Step{
+			Command: []string{absCatPath, "file.txt"},
+			Dir:     "//testdata_out",
+		}
+
+		output := StepLog{
+			Step: Step{
+				Command: []string{absCatPath, "file.txt"},
+				Dir:     filepath.FromSlash(startDir + "/testdata_out"),
+			},
+			StepResult: StepResult{
+				Stdout: "rooted",
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should error if a dir does not exist", func(t *testing.T) {
+		expectError(t, []Step{{
+			Command: []string{echoPath},
+			Dir:     "//missing",
+		}})
+	})
+
+	t.Run("should stream stdin to a command", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		go func() {
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(writer, "line %d\n", i)
+			}
+			writer.Close()
+		}()
+
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+		}
+		result := runner.RunWithStdin("cat", Step{Command: []string{"./" + catPath}}, reader)
+
+		if expected := "line 0\nline 1\nline 2\n"; result.Stdout != expected {
+			t.Errorf("expected stdout %q. Got %q", expected, result.Stdout)
+		}
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		if log.Stdin != stdinMarker {
+			t.Errorf("expected stdin %q. Got %q", stdinMarker, log.Stdin)
+		}
+	})
+
+	t.Run("should pipe step stdin to a command", func(t *testing.T) {
+		input := Step{
+			Command: []string{catPath},
+			Stdin:   "piped input",
+		}
+
+		output := StepLog{
+			Step: Step{
+				Command: []string{catPath},
+				Stdin:   "piped input",
+			},
+			StepResult: StepResult{
+				Stdout: "piped input",
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should pipe a placeholder's contents to a command", func(t *testing.T) {
+		placeholder := Placeholder("placeholder input")
+		runner := &prodRunner{
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: new(bytes.Buffer),
+		}
+		result := runner.Run("cat", Step{Command: []string{"./" + catPath}, Stdin: placeholder})
+
+		if result.Stdout != "placeholder input" {
+			t.Errorf("expected stdout %q. Got %q", "placeholder input", result.Stdout)
+		}
+	})
+
+	t.Run("should record output if streaming it fails", func(t *testing.T) {
+		runner := &prodRunner{
+			stdout:     failingWriter{},
+			stderr:     os.Stderr,
+			stepOutput: new(bytes.Buffer),
+		}
+		result := runner.Run("echo", Step{Command: []string{"./" + echoPath, "recorded"}})
+
+		if result.Stdout != "recorded" {
+			t.Errorf("expected stdout %q. Got %q", "recorded", result.Stdout)
+		}
+		if result.ExitCode != 0 {
+			t.Errorf("expected exit code 0. Got %d", result.ExitCode)
+		}
+	})
+
+	t.Run("should record output separately by default", func(t *testing.T) {
+		input := Step{
+			Command: []string{"./" + interleavePath, "a", "b", "c", "d"},
+		}
+
+		output := StepLog{
+			Step: input,
+			StepResult: StepResult{
+				Stdout: "a\nc\n",
+				Stderr: "b\nd\n",
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should record interleaved output when combined", func(t *testing.T) {
+		input := Step{
+			Command:  []string{"./" + interleavePath, "a", "b", "c", "d"},
+			Combined: true,
+		}
+
+		output := StepLog{
+			Step: input,
+			StepResult: StepResult{
+				Combined: "a\nb\nc\nd\n",
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should stream large output to a file", func(t *testing.T) {
+		placeholder := Placeholder("")
+
+		var stepOutput bytes.Buffer
+		var result StepResult
+		err := runRunnable(func(r Runner) {
+			result = r.Run("lines", Step{
+				Command:        []string{"./" + linesPath, "20000"},
+				StreamOutputTo: placeholder,
+			})
+		}, new(bytes.Buffer), os.Stderr, options{stepLog: &stepOutput})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		contents, err := ReadPlaceholder(placeholder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+		if len(lines) != 20000 || lines[0] != "line 0" || lines[19999] != "line 19999" {
+			t.Errorf("expected the file to contain all 20000 lines. Got %d", len(lines))
+		}
+		if len(result.Stdout) != StreamedOutputTail {
+			t.Errorf("expected %d bytes of stdout. Got %d", StreamedOutputTail, len(result.Stdout))
+		}
+		if !strings.HasSuffix(contents, result.Stdout) {
+			t.Errorf("expected stdout to hold the tail of the output")
+		}
+
+		var log StepLog
+		if err := json.Unmarshal(stepOutput.Bytes(), &log); err != nil {
+			t.Fatal(err)
+		}
+		if path := PlaceholderPath(placeholderID(placeholder)); log.Step.StreamOutputTo != path {
+			t.Errorf("expected the log to record the output file %q. Got %q", path, log.Step.StreamOutputTo)
+		}
+	})
+
+	t.Run("should cap recorded output", func(t *testing.T) {
+		var result StepResult
+		err := runRunnable(func(r Runner) {
+			// Prints 790 bytes.
+			result = r.Run("lines", Step{
+				Command:        []string{"./" + linesPath, "100"},
+				MaxOutputBytes: 50,
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		expected := "line 0\nline 1\nline 2\nline 3\nline 4\nline 5\nline 6\nl" +
+			"...[truncated 740 bytes]"
+		if result.Stdout != expected {
+			t.Errorf("expected stdout %q. Got %q", expected, result.Stdout)
+		}
+	})
+
+	t.Run("should stream combined output to a file", func(t *testing.T) {
+		placeholder := Placeholder("")
+		var result StepResult
+		err := runRunnable(func(r Runner) {
+			result = r.Run("interleave", Step{
+				Command:        []string{"./" + interleavePath, "a", "b"},
+				Combined:       true,
+				StreamOutputTo: placeholder,
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		contents, err := ReadPlaceholder(placeholder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents != "a\nb\n" || result.Combined != "a\nb\n" {
+			t.Errorf("expected the file and result to hold the combined output. Got %q and %q",
+				contents, result.Combined)
+		}
+	})
+
+	t.Run("should record the exit code of a command", func(t *testing.T) {
+		input := Step{
+			Command: []string{"./" + exitPath, "3"},
+		}
+
+		output := StepLog{
+			Step: Step{
+				Command: []string{"./" + exitPath, "3"},
+			},
+			StepResult: StepResult{
+				ExitCode: 3,
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should error if a command exits with a non-zero code", func(t *testing.T) {
+		expectError(t, []Step{{
+			Command:           []string{"./" + exitPath, "3"},
+			FailOnNonZeroExit: true,
+		}})
+	})
+
+	t.Run("should stop running all steps after a fatal error", func(t *testing.T) {
+		defer os.Remove("run_all.txt")
+		err := runRunnable(func(r Runner) {
+			r.RunAll("steps", []Step{
+				{Command: []string{"./" + exitPath, "1"}, FailOnNonZeroExit: true},
+				{Command: []string{"./" + touchPath, "run_all.txt"}},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err == nil {
+			t.Fatalf("expected an error. got nil")
+		}
+		if _, err := os.Stat("run_all.txt"); !os.IsNotExist(err) {
+			t.Errorf("expected the second step not to run. Got %v", err)
+		}
+	})
+
+	t.Run("should run steps in parallel", func(t *testing.T) {
+		var steps []Step
+		for i := 0; i < 8; i++ {
+			steps = append(steps, Step{Command: []string{"./" + echoPath, fmt.Sprint(i)}})
+		}
+
+		var stepOutput bytes.Buffer
+		var results []StepResult
+		err := runRunnable(func(r Runner) {
+			results = r.RunParallel("echo", steps)
+		}, new(bytes.Buffer), os.Stderr, options{stepLog: &stepOutput})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		for i, result := range results {
+			if result.Stdout != fmt.Sprint(i) {
+				t.Errorf("expected result %d to have stdout %q. Got %q", i, fmt.Sprint(i), result.Stdout)
+			}
+		}
+		names := make(map[string]bool)
+		decoder := json.NewDecoder(&stepOutput)
+		for decoder.More() {
+			var log StepLog
+			if err := decoder.Decode(&log); err != nil {
+				t.Fatalf("failed to decode step output: %v", err)
+			}
+			names[log.StepName] = true
+		}
+		for i := range steps {
+			if name := fmt.Sprintf("echo_%d", i); !names[name] {
+				t.Errorf("expected a log for step %q. Got %v", name, names)
+			}
+		}
+	})
+
+	t.Run("should raise a fatal error from a parallel step", func(t *testing.T) {
+		err := runRunnable(func(r Runner) {
+			r.RunParallel("steps", []Step{
+				{Command: []string{"./" + echoPath}},
+				{Command: []string{"./" + exitPath, "1"}, FailOnNonZeroExit: true},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err == nil || !strings.Contains(err.Error(), "step failed") {
+			t.Errorf("expected a step failure. Got %v", err)
+		}
+	})
+
+	t.Run("should not require outputs of a tolerated failure", func(t *testing.T) {
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command: []string{"./" + exitPath, "1"},
+				Outputs: []string{"//CWD/missing.txt"},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should remove partial outputs of a failed step", func(t *testing.T) {
+		defer os.Remove("partial.txt")
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command:                []string{"./" + exitPath, "1", "partial.txt"},
+				Outputs:                []string{"//CWD/partial.txt"},
+				RemoveOutputsOnFailure: true,
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if _, err := os.Stat("partial.txt"); !os.IsNotExist(err) {
+			t.Errorf("expected partial.txt to be removed. Got %v", err)
+		}
+	})
+
+	t.Run("should keep data that existed before a failed step", func(t *testing.T) {
+		defer os.RemoveAll("partial_dir")
+		defer os.Remove("partial_old.txt")
+		if err := os.Mkdir("partial_dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"partial_dir/old.txt", "partial_old.txt"} {
+			if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command:                []string{"./" + exitPath, "1", "partial_dir/new.txt", "partial_old.txt"},
+				Outputs:                []string{"//CWD/partial_dir", "//CWD/partial_old.txt"},
+				RemoveOutputsOnFailure: true,
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+
+		for _, path := range []string{"partial_dir/old.txt", "partial_old.txt"} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("expected %s to be kept. Got %v", path, err)
+			}
+		}
+		if _, err := os.Stat("partial_dir/new.txt"); !os.IsNotExist(err) {
+			t.Errorf("expected partial_dir/new.txt to be removed. Got %v", err)
+		}
+	})
+
+	t.Run("should keep outputs of a failed step by default", func(t *testing.T) {
+		defer os.Remove("partial.txt")
+		runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command: []string{"./" + exitPath, "1", "partial.txt"},
+				Outputs: []string{"//CWD/partial.txt"},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+
+		if _, err := os.Stat("partial.txt"); err != nil {
+			t.Errorf("expected partial.txt to be kept. Got %v", err)
+		}
+	})
+
+	t.Run("should require outputs of a successful step", func(t *testing.T) {
+		expectError(t, []Step{{
+			Command: []string{"./" + exitPath, "0"},
+			Outputs: []string{"//CWD/missing.txt"},
+		}})
+	})
+
+	t.Run("should record a negative exit code for a command killed by a signal", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Signals are not supported on Windows")
+		}
+
+		input := Step{
+			Command: []string{"./" + killPath},
+		}
+
+		output := StepLog{
+			Step: Step{
+				Command: []string{"./" + killPath},
+			},
+			StepResult: StepResult{
+				ExitCode: -int(syscall.SIGKILL),
+			},
+		}
+
+		expectOutput(t, input, output)
+	})
+
+	t.Run("should error if a command produces a forbidden output", func(t *testing.T) {
+		defer os.Remove("forbidden.txt")
+		expectError(t, []Step{{
+			Command:       []string{"./" + touchPath, "forbidden.txt"},
+			ForbidOutputs: []string{"//CWD/forbidden.txt"},
 		}})
 	})
 
+	t.Run("should not error if a command avoids forbidden outputs", func(t *testing.T) {
+		defer os.Remove("allowed.txt")
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command:       []string{"./" + touchPath, "allowed.txt"},
+				ForbidOutputs: []string{"//CWD/forbidden.txt"},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should record output digests when requested", func(t *testing.T) {
+		defer os.Remove("hashed.txt")
+		startDir, _ := os.Getwd()
+
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			startDir:    startDir,
+			stdout:      new(bytes.Buffer),
+			stderr:      os.Stderr,
+			stepOutput:  &stepOutput,
+			hashOutputs: true,
+		}
+		runner.Run("", Step{
+			Command: []string{"./" + touchPath, "hashed.txt"},
+			Outputs: []string{"//CWD/hashed.txt"},
+		})
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step output: %v", err)
+		}
+		// The sha256 digest of an empty file.
+		expected := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		path := filepath.Join(startDir, "hashed.txt")
+		if log.OutputDigests[path] != expected {
+			t.Errorf("expected digest %q for %s. Got %v", expected, path, log.OutputDigests)
+		}
+	})
+
+	t.Run("should record output modes only when requested", func(t *testing.T) {
+		defer os.Remove("moded.txt")
+		startDir, _ := os.Getwd()
+
+		for _, record := range []bool{false, true} {
+			var stepOutput bytes.Buffer
+			runner := &prodRunner{
+				startDir:          startDir,
+				stdout:            new(bytes.Buffer),
+				stderr:            os.Stderr,
+				stepOutput:        &stepOutput,
+				recordOutputModes: record,
+			}
+			runner.Run("", Step{
+				Command: []string{"./" + touchPath, "moded.txt"},
+				Outputs: []string{"//CWD/moded.txt"},
+			})
+
+			var log StepLog
+			if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+				t.Fatalf("failed to decode step output: %v", err)
+			}
+			if recorded := log.OutputModes != nil; recorded != record {
+				t.Errorf("expected output modes to be recorded: %v. Got %v", record, log.OutputModes)
+			}
+		}
+	})
+
+	t.Run("should error if a command writes an undeclared file to the start dir", func(t *testing.T) {
+		defer os.Remove("undeclared.txt")
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{Command: []string{"./" + touchPath, "undeclared.txt"}})
+		}, new(bytes.Buffer), os.Stderr, options{guardStartDir: true})
+		if err == nil {
+			t.Fatalf("expected an error. got nil")
+		}
+	})
+
+	t.Run("should not error if a command writes a declared file to the start dir", func(t *testing.T) {
+		defer os.Remove("declared.txt")
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command: []string{"./" + touchPath, "declared.txt"},
+				Outputs: []string{"//CWD/declared.txt"},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{guardStartDir: true})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should not attribute a parallel step's outputs to its siblings", func(t *testing.T) {
+		defer os.Remove("sibling.txt")
+		err := runRunnable(func(r Runner) {
+			r.RunParallel("parallel", []Step{
+				{
+					Command:       []string{"./" + sleepPath, "300ms"},
+					ForbidOutputs: []string{"//CWD/sibling.txt"},
+				},
+				{
+					Command: []string{"./" + touchPath, "sibling.txt"},
+					Outputs: []string{"//CWD/sibling.txt"},
+				},
+			})
+		}, new(bytes.Buffer), os.Stderr, options{guardStartDir: true})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should resolve log files and list them in the summary", func(t *testing.T) {
+		defer os.Remove("build.log")
+		var stdout bytes.Buffer
+		err := runRunnable(func(r Runner) {
+			r.Run("build", Step{
+				Command:  []string{"./" + touchPath, "build.log"},
+				LogFiles: map[string]string{"build": "//CWD/build.log"},
+			})
+		}, &stdout, os.Stderr, options{})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		decoder := json.NewDecoder(&stdout)
+		var log StepLog
+		var summary RunSummary
+		if err := decoder.Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		if err := decoder.Decode(&summary); err != nil {
+			t.Fatalf("failed to decode run summary: %v", err)
+		}
+
+		startDir, _ := os.Getwd()
+		expected := map[string]string{"build": filepath.Join(startDir, "build.log")}
+		if !reflect.DeepEqual(expected, log.Step.LogFiles) {
+			t.Errorf("expected log files %v. Got %v", expected, log.Step.LogFiles)
+		}
+		if !reflect.DeepEqual(expected, summary.LogFiles["build"]) {
+			t.Errorf("expected summary log files %v. Got %v", expected, summary.LogFiles)
+		}
+	})
+
+	t.Run("should error if a binary does not exist", func(t *testing.T) {
+		expectError(t, []Step{{
+			Command: []string{"i_dont_exist"},
+		}})
+	})
+
+	t.Run("should error if the binary resolver cannot find a binary", func(t *testing.T) {
+		runner := &prodRunner{
+			stdout:     os.Stdout,
+			stderr:     os.Stderr,
+			stepOutput: new(bytes.Buffer),
+			lookPath: func(file string) (string, error) {
+				return "", exec.ErrNotFound
+			},
+		}
+
+		err := recoverFatal(func() {
+			runner.Run("", Step{Command: []string{echoPath}})
+		})
+		if err == nil {
+			t.Fatalf("expected an error. got nil")
+		}
+		if !strings.Contains(err.Error(), "failed to find binary") {
+			t.Errorf("expected a missing binary error. Got %v", err)
+		}
+	})
+
+	t.Run("should run the binary found by the binary resolver", func(t *testing.T) {
+		absEchoPath, _ := filepath.Abs(echoPath)
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+			lookPath: func(file string) (string, error) {
+				if file != "fake_echo" {
+					return "", exec.ErrNotFound
+				}
+				return absEchoPath, nil
+			},
+		}
+
+		result := runner.Run("", Step{Command: []string{"fake_echo", "resolved"}})
+		if result.Stdout != "resolved" {
+			t.Errorf("expected stdout %q. Got %q", "resolved", result.Stdout)
+		}
+	})
+
+	t.Run("should log resolved steps without running them in a dry run", func(t *testing.T) {
+		defer os.Remove("dryrun.txt")
+
+		var stepLog bytes.Buffer
+		err := runMain(func(r Runner) {
+			r.Run("touch", Step{
+				Command: []string{"./" + touchPath, "//dryrun.txt"},
+				Outputs: []string{"//dryrun.txt"},
+			})
+			r.AssertExists("//dryrun.txt")
+		}, nil, []string{"-chow.dryrun"}, MainOptions{Stdout: new(bytes.Buffer), StepLog: &stepLog})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		if _, err := os.Stat("dryrun.txt"); !os.IsNotExist(err) {
+			t.Errorf("expected the step not to run. Got %v", err)
+		}
+
+		var log StepLog
+		if err := json.NewDecoder(&stepLog).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		startDir, _ := os.Getwd()
+		expected := StepLog{
+			StepName: "touch",
+			Step: Step{
+				Command: []string{"./" + touchPath, filepath.Join(startDir, "dryrun.txt")},
+				Outputs: []string{filepath.Join(startDir, "dryrun.txt")},
+			},
+		}
+		expectLogsEqual(t, expected, log)
+	})
+
+	t.Run("should not require earlier steps' files in a dry run", func(t *testing.T) {
+		err := runMain(func(r Runner) {
+			r.Run("mkdir", Step{Command: []string{"mkdir", "//dryrun_dir"}, Outputs: []string{"//dryrun_dir"}})
+			r.Run("build", Step{Command: []string{"//dryrun_dir/build"}, Dir: "//dryrun_dir"})
+		}, nil, []string{"-chow.dryrun"}, MainOptions{Stdout: new(bytes.Buffer), StepLog: new(bytes.Buffer)})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+		if _, err := os.Stat("dryrun_dir"); !os.IsNotExist(err) {
+			t.Errorf("expected the step not to run. Got %v", err)
+		}
+	})
+
+	t.Run("should record resolved steps without running them", func(t *testing.T) {
+		recordFile, err := ioutil.TempFile("", "record")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recordFile.Close()
+		defer os.Remove(recordFile.Name())
+
+		var stdout bytes.Buffer
+		err = runRunnable(func(r Runner) {
+			r.Run("echo", Step{
+				Command: []string{echoPath, "//path/to/file"},
+				Outputs: []string{"missing.txt"},
+			})
+		}, &stdout, os.Stderr, options{recordPath: recordFile.Name()})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		var logs []StepLog
+		contents, _ := ioutil.ReadFile(recordFile.Name())
+		if err := json.Unmarshal(contents, &logs); err != nil {
+			t.Fatalf("failed to decode record file: %v", err)
+		}
+
+		startDir, _ := os.Getwd()
+		expected := StepLog{
+			StepName: "echo",
+			Step: Step{
+				Command: []string{echoPath, filepath.FromSlash(startDir + "/path/to/file")},
+				Outputs: []string{"missing.txt"},
+			},
+		}
+		if len(logs) != 1 {
+			t.Fatalf("expected one step log. Got %v", logs)
+		}
+		expectLogsEqual(t, expected, logs[0])
+	})
+
+	t.Run("should apply the default timeout to a step without a timeout", func(t *testing.T) {
+		runner := &prodRunner{
+			stdout:         os.Stdout,
+			stderr:         os.Stderr,
+			stepOutput:     new(bytes.Buffer),
+			defaultTimeout: 100 * time.Millisecond,
+		}
+
+		start := time.Now()
+		err := recoverFatal(func() {
+			runner.Run("", Step{Command: []string{"./" + sleepPath, "10s"}})
+		})
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the step to be killed. Took %v", elapsed)
+		}
+		if err == nil || !strings.Contains(err.Error(), "step timed out") {
+			t.Errorf("expected a timeout error. Got %v", err)
+		}
+	})
+
+	t.Run("should log a step that exceeds its timeout", func(t *testing.T) {
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			stdout:     os.Stdout,
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+		}
+
+		err := recoverFatal(func() {
+			runner.Run("", Step{
+				Command: []string{"./" + sleepPath, "10s"},
+				Timeout: 100 * time.Millisecond,
+			})
+		})
+		if err == nil {
+			t.Fatalf("expected an error. got nil")
+		}
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		if log.StepResult.ExitCode != TimeoutExitCode {
+			t.Errorf("expected exit code %d. Got %d", TimeoutExitCode, log.StepResult.ExitCode)
+		}
+	})
+
+	t.Run("should prefer a step's timeout to the default timeout", func(t *testing.T) {
+		runner := &prodRunner{
+			stdout:         os.Stdout,
+			stderr:         os.Stderr,
+			stepOutput:     new(bytes.Buffer),
+			defaultTimeout: 100 * time.Millisecond,
+		}
+
+		result := runner.Run("", Step{
+			Command: []string{"./" + sleepPath, "300ms"},
+			Timeout: 10 * time.Second,
+		})
+		if result.ExitCode != 0 {
+			t.Errorf("expected exit code 0. Got %d", result.ExitCode)
+		}
+	})
+
+	// Runs step with a new runner, returning its log and any fatal error.
+	runRetried := func(t *testing.T, step Step) (StepLog, error) {
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+		}
+		err := recoverFatal(func() { runner.Run("", step) })
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		return log, err
+	}
+
+	t.Run("should retry a step that exits with a non-zero code", func(t *testing.T) {
+		log, _ := runRetried(t, Step{Command: []string{"./" + exitPath, "3"}, Retries: 2})
+		if log.Attempts != 3 || log.StepResult.ExitCode != 3 {
+			t.Errorf("expected 3 attempts that exited with code 3. Got %d with code %d",
+				log.Attempts, log.StepResult.ExitCode)
+		}
+	})
+
+	t.Run("should not retry a step that succeeds", func(t *testing.T) {
+		log, err := runRetried(t, Step{Command: []string{"./" + exitPath, "0"}, Retries: 2})
+		if err != nil || log.Attempts != 1 {
+			t.Errorf("expected a single successful attempt. Got %d attempts and %v", log.Attempts, err)
+		}
+	})
+
+	t.Run("should apply the timeout to each attempt", func(t *testing.T) {
+		log, err := runRetried(t, Step{
+			Command: []string{"./" + sleepPath, "10s"},
+			Timeout: 100 * time.Millisecond,
+			Retries: 2,
+		})
+		if err == nil || !strings.Contains(err.Error(), "attempt timed out") {
+			t.Errorf("expected an attempt timeout error. Got %v", err)
+		}
+		if log.Attempts != 3 || log.TimeoutLimit != "timeout" {
+			t.Errorf("expected 3 attempts killed by the timeout. Got %d killed by %q",
+				log.Attempts, log.TimeoutLimit)
+		}
+	})
+
+	t.Run("should stop retrying once the total timeout has elapsed", func(t *testing.T) {
+		start := time.Now()
+		log, err := runRetried(t, Step{
+			Command:      []string{"./" + sleepPath, "10s"},
+			Timeout:      200 * time.Millisecond,
+			TotalTimeout: 500 * time.Millisecond,
+			Retries:      10,
+		})
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the step to be killed. Took %v", elapsed)
+		}
+		if err == nil || !strings.Contains(err.Error(), "total budget exhausted") {
+			t.Errorf("expected a total timeout error. Got %v", err)
+		}
+		if log.Attempts < 2 || log.Attempts > 4 || log.TimeoutLimit != "total_timeout" {
+			t.Errorf("expected 2 to 4 attempts killed by the total timeout. Got %d killed by %q",
+				log.Attempts, log.TimeoutLimit)
+		}
+	})
+
+	t.Run("should include only the tail of the output in errors", func(t *testing.T) {
+		var contents bytes.Buffer
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(&contents, "line %d\n", i)
+		}
+
+		err := runRunnable(func(r Runner) {
+			r.Run("", Step{
+				Command: []string{catPath, Placeholder(contents.String())},
+				Outputs: []string{"missing.txt"},
+			})
+		}, new(bytes.Buffer), new(bytes.Buffer), options{})
+		if err == nil {
+			t.Fatalf("expected an error. got nil")
+		}
+
+		message := err.Error()
+		if !strings.Contains(message, "truncated") {
+			t.Errorf("expected error to note that output was truncated: %s", message)
+		}
+		if !strings.Contains(message, "line 99\n") {
+			t.Errorf("expected error to contain the last line of output: %s", message)
+		}
+		if strings.Contains(message, "line 0\n") {
+			t.Errorf("expected error to omit the first line of output: %s", message)
+		}
+	})
+
+}
+
+func TestTestRunner_Run(t *testing.T) {
+	// Expects that executing the given steps w/ the given mocks produces the given step
+	// log.  Results in a test failure if the actual log differs.
+	expectOutput := func(t *testing.T, step []Step, mocks []Mock, expected []StepLog) {
+		// Execute the program.
+		runner := &testRunner{Mocks: mocks}
+		for i := range step {
+			runner.Run("step_"+fmt.Sprint(i), step[i])
+		}
+
+		// Verify the results.
+		actual := runner.stepLogs
+		if len(expected) != len(actual) {
+			t.Fatalf("expected %v Got %v", expected, actual)
+		}
+
+		for i := 0; i < len(expected); i++ {
+			expectLogsEqual(t, expected[i], actual[i])
+		}
+	}
+
+	t.Run("step output should be mocked", func(t *testing.T) {
+		t.Run("when a mock step name matches", func(t *testing.T) {
+			step := Step{Command: []string{"command"}}
+			inputs := []Step{step, step, step}
+
+			mocks := []Mock{{
+				Step: "step_1",
+				Result: StepResult{
+					Stdout:   "mocked stdout",
+					Stderr:   "mocked stderr",
+					ExitCode: 31,
+				},
+			}}
+
+			result := []StepLog{{
+				StepName:   "step_0",
+				Step:       step,
+				StepResult: StepResult{},
+			}, {
+				StepName: "step_1",
+				Step:     step,
+				StepResult: StepResult{
+					Stdout:   "mocked stdout",
+					Stderr:   "mocked stderr",
+					ExitCode: 31,
+				},
+			}, {
+				StepName:   "step_2",
+				Step:       step,
+				StepResult: StepResult{},
+			}}
+
+			expectOutput(t, inputs, mocks, result)
+		})
+	})
+
+	t.Run("step output should be empty", func(t *testing.T) {
+		t.Run("when there are no mocks", func(t *testing.T) {
+			inputs := []Step{{
+				Command: []string{"command", "arg1", "arg2"},
+				Outputs: []string{"output"},
+			}}
+
+			result := []StepLog{{
+				StepName: "step_0",
+				Step:     inputs[0],
+			}}
+
+			expectOutput(t, inputs, []Mock{}, result)
+		})
+		t.Run("when a mock step name does not match", func(t *testing.T) {
+			inputs := []Step{{
+				Command: []string{"command", "arg1", "arg2"},
+				Outputs: []string{"output"},
+			}}
+
+			result := []StepLog{{
+				StepName: "step_0",
+				Step:     inputs[0],
+			}}
+
+			expectOutput(t, inputs, []Mock{}, result)
+		})
+	})
+}
+
+func TestRunMain(t *testing.T) {
+	echoPath := buildTestBinary(t, "echo")
+	defer os.RemoveAll(echoPath)
+
+	t.Run("should parse flags before running the runnable", func(t *testing.T) {
+		var name string
+		flags := flag.NewFlagSet("test", flag.ExitOnError)
+		flags.StringVar(&name, "name", "Anonymous", "The user to greet")
+
+		var stdout bytes.Buffer
+		err := runMain(func(r Runner) {
+			r.Run("greet", Step{Command: []string{"./" + echoPath, "Hello, " + name}})
+		}, flags, []string{"-name=chow"}, MainOptions{Stdout: &stdout})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if !strings.Contains(stdout.String(), "Hello, chow") {
+			t.Errorf("expected the flag value in stdout. Got %s", stdout.String())
+		}
+	})
+
+	t.Run("should return an error for invalid flags", func(t *testing.T) {
+		flags := flag.NewFlagSet("test", flag.ExitOnError)
+		flags.SetOutput(new(bytes.Buffer))
+
+		err := runMain(func(r Runner) {}, flags, []string{"-unknown"}, MainOptions{})
+		if err == nil || !strings.Contains(err.Error(), "failed to parse flags") {
+			t.Errorf("expected a flag parsing error. Got %v", err)
+		}
+		if flags.ErrorHandling() != flag.ExitOnError {
+			t.Errorf("expected the flag set's error handling to be restored. Got %v", flags.ErrorHandling())
+		}
+	})
+
+	t.Run("should accept a nil flag set", func(t *testing.T) {
+		if err := runMain(func(r Runner) {}, nil, nil, MainOptions{}); err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should remove placeholders when finished", func(t *testing.T) {
+		var path string
+		err := runMain(func(r Runner) {
+			path = PlaceholderPath(placeholderID(Placeholder("contents")))
+		}, nil, nil, MainOptions{})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed. Got %v", path, err)
+		}
+	})
+
+	t.Run("should write to the given writers", func(t *testing.T) {
+		var stdout, stepLog bytes.Buffer
+		err := runMain(func(r Runner) {
+			r.Run("greet", Step{Command: []string{"./" + echoPath, "Hello"}})
+		}, nil, nil, MainOptions{Stdout: &stdout, Stderr: new(bytes.Buffer), StepLog: &stepLog})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if stdout.String() != "Hello" {
+			t.Errorf("expected stdout %q. Got %q", "Hello", stdout.String())
+		}
+		var log StepLog
+		if err := json.NewDecoder(&stepLog).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		if log.StepName != "greet" || log.StepResult.Stdout != "Hello" {
+			t.Errorf("expected a log of step %q. Got %+v", "greet", log)
+		}
+	})
+
+	t.Run("should pass properties to the application", func(t *testing.T) {
+		var stdout bytes.Buffer
+		err := runMain(func(r Runner) {
+			props := struct{ Greeting string }{Greeting: "Goodbye"}
+			r.Properties(&props)
+			r.Run("greet", Step{Command: []string{"./" + echoPath, props.Greeting}})
+		}, nil, []string{"-chow.properties", `{"greeting": "Hello"}`},
+			MainOptions{Stdout: &stdout, StepLog: new(bytes.Buffer)})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if stdout.String() != "Hello" {
+			t.Errorf("expected stdout %q. Got %q", "Hello", stdout.String())
+		}
+	})
+
+	t.Run("should error for an unknown property", func(t *testing.T) {
+		err := runMain(func(r Runner) {
+			var props struct{ Greeting string }
+			r.Properties(&props)
+		}, nil, []string{"-chow.properties", `{"farewell": "Bye"}`}, MainOptions{})
+		if err == nil || !strings.Contains(err.Error(), "failed to read properties") {
+			t.Errorf("expected a properties error. Got %v", err)
+		}
+	})
+
+	t.Run("should print resolved commands if verbose", func(t *testing.T) {
+		var stderr bytes.Buffer
+		err := runMain(func(r Runner) {
+			r.Run("greet", Step{Command: []string{"./" + echoPath, "//path/to/file"}})
+		}, nil, []string{"-chow.verbose"}, MainOptions{Stdout: new(bytes.Buffer), Stderr: &stderr})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		startDir, _ := os.Getwd()
+		expected := fmt.Sprintf("chow: running \"greet\": ./%s %s\n", echoPath,
+			filepath.Join(startDir, "path", "to", "file"))
+		if stderr.String() != expected {
+			t.Errorf("expected stderr %q. Got %q", expected, stderr.String())
+		}
+	})
+
+	t.Run("should parse the given args", func(t *testing.T) {
+		var name string
+		flags := flag.NewFlagSet("test", flag.ExitOnError)
+		flags.StringVar(&name, "name", "Anonymous", "The user to greet")
+
+		var stdout bytes.Buffer
+		err := MainWith(func(r Runner) {
+			r.Run("greet", Step{Command: []string{"./" + echoPath, "Hello, " + name}})
+		}, flags, MainOptions{Args: []string{"-name=args"}, Stdout: &stdout})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		if !strings.Contains(stdout.String(), "Hello, args") {
+			t.Errorf("expected the flag value in stdout. Got %s", stdout.String())
+		}
+	})
+
+	t.Run("should write step logs to the given log writer", func(t *testing.T) {
+		var logs MemoryLogWriter
+		var stepLog bytes.Buffer
+		err := runMain(func(r Runner) {
+			r.Run("first", Step{Command: []string{"./" + echoPath, "1"}})
+			r.Run("second", Step{Command: []string{"./" + echoPath, "2"}})
+		}, nil, nil, MainOptions{Stdout: new(bytes.Buffer), StepLog: &stepLog, LogWriter: &logs})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		var names []string
+		for _, log := range logs.Entries {
+			names = append(names, log.StepName)
+		}
+		if expected := []string{"first", "second"}; !reflect.DeepEqual(expected, names) {
+			t.Errorf("expected step logs %v. Got %v", expected, names)
+		}
+		if stepLog.Len() > 0 {
+			t.Errorf("expected no JSON step logs. Got:\n%s", stepLog.String())
+		}
+	})
+}
+
+func TestMainResult(t *testing.T) {
+	exitPath := buildTestBinary(t, "exit")
+	defer os.RemoveAll(exitPath)
+
+	run := func(r Runnable, args ...string) RunResult {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(new(bytes.Buffer))
+		return mainResult(r, flags, args, MainOptions{
+			Stdout: new(bytes.Buffer),
+			Stderr: new(bytes.Buffer),
+		})
+	}
+
+	t.Run("should return the exit code of the failed step", func(t *testing.T) {
+		result := run(func(r Runner) {
+			r.Run("fail", Step{Command: []string{"./" + exitPath, "42"}, FailOnNonZeroExit: true})
+		})
+		if result.ExitCode != 42 {
+			t.Errorf("expected exit code 42. Got %d", result.ExitCode)
+		}
+		if result.Err == nil {
+			t.Errorf("expected an error. Got nil")
+		}
+	})
+
+	t.Run("should return zero when all steps succeed", func(t *testing.T) {
+		result := run(func(r Runner) {
+			r.Run("pass", Step{Command: []string{"./" + exitPath, "0"}})
+		})
+		if result.ExitCode != 0 || result.Err != nil {
+			t.Errorf("expected exit code 0 and no error. Got %d, %v", result.ExitCode, result.Err)
+		}
+	})
+
+	t.Run("should return zero when non-zero exit codes are tolerated", func(t *testing.T) {
+		result := run(func(r Runner) {
+			r.Run("tolerated", Step{Command: []string{"./" + exitPath, "3"}})
+		})
+		if result.ExitCode != 0 || result.Err != nil {
+			t.Errorf("expected exit code 0 and no error. Got %d, %v", result.ExitCode, result.Err)
+		}
+	})
+
+	t.Run("should return the exit code of the step that failed the run", func(t *testing.T) {
+		result := run(func(r Runner) {
+			r.Run("tolerated", Step{Command: []string{"./" + exitPath, "3"}})
+			r.Run("fail", Step{Command: []string{"./" + exitPath, "5"}, FailOnNonZeroExit: true})
+		})
+		if result.ExitCode != 5 {
+			t.Errorf("expected exit code 5. Got %d", result.ExitCode)
+		}
+	})
+
+	t.Run("should return 1 if the run failed after a tolerated step", func(t *testing.T) {
+		result := run(func(r Runner) {
+			r.Run("tolerated", Step{Command: []string{"./" + exitPath, "3"}})
+			r.Run("missing", Step{Command: []string{"./" + exitPath, "0"}, Outputs: []string{"//CWD/missing.txt"}})
+		})
+		if result.ExitCode != 1 || result.Err == nil {
+			t.Errorf("expected exit code 1 and an error. Got %d, %v", result.ExitCode, result.Err)
+		}
+	})
+
+	t.Run("should summarize passing and failing steps", func(t *testing.T) {
+		summaryFile, err := ioutil.TempFile("", "summary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaryFile.Close()
+		defer os.Remove(summaryFile.Name())
+		summaryPath := summaryFile.Name()
+
+		result := run(func(r Runner) {
+			r.Run("pass", Step{Command: []string{"./" + exitPath, "0"}})
+			r.Run("tolerated", Step{Command: []string{"./" + exitPath, "3"}})
+			r.Run("fail", Step{Command: []string{"./" + exitPath, "4"}, FailOnNonZeroExit: true})
+			r.Run("skipped", Step{Command: []string{"./" + exitPath, "0"}})
+		}, "-chow.summary="+summaryPath)
+
+		if result.Summary.Steps != 3 || result.Summary.Failures != 2 {
+			t.Errorf("expected 3 steps and 2 failures. Got %d and %d",
+				result.Summary.Steps, result.Summary.Failures)
+		}
+		var names []string
+		for _, step := range result.Summary.SlowestSteps {
+			names = append(names, step.Name)
+		}
+		sort.Strings(names)
+		if expected := []string{"fail", "pass", "tolerated"}; !reflect.DeepEqual(expected, names) {
+			t.Errorf("expected slowest steps %v. Got %v", expected, names)
+		}
+
+		contents, err := ioutil.ReadFile(summaryPath)
+		if err != nil {
+			t.Fatalf("expected a summary file. Got %v", err)
+		}
+		var summary RunSummary
+		if err := json.Unmarshal(contents, &summary); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Steps != 3 || summary.Failures != 2 || summary.Duration != result.Summary.Duration {
+			t.Errorf("expected the summary file to match the result. Got %+v", summary)
+		}
+	})
+
+	t.Run("should only log the summary if the run used phases", func(t *testing.T) {
+		for _, phased := range []bool{false, true} {
+			var stepLog bytes.Buffer
+			mainResult(func(r Runner) {
+				r.Run("pass", Step{Command: []string{"./" + exitPath, "0"}})
+				if phased {
+					r.Phase("phase", func(r Runner) {})
+				}
+			}, nil, []string{}, MainOptions{Stdout: new(bytes.Buffer), StepLog: &stepLog})
+
+			decoder := json.NewDecoder(&stepLog)
+			var log StepLog
+			if err := decoder.Decode(&log); err != nil {
+				t.Fatalf("failed to decode step log: %v", err)
+			}
+			var summary RunSummary
+			err := decoder.Decode(&summary)
+			if logged := err == nil; logged != phased {
+				t.Errorf("expected the summary to be logged: %v. Got %v", phased, err)
+			}
+			if phased && summary.Steps != 1 {
+				t.Errorf("expected a summary of 1 step. Got %+v", summary)
+			}
+		}
+	})
+
+	t.Run("should return 2 for invalid flags", func(t *testing.T) {
+		result := run(func(r Runner) {}, "-unknown")
+		if result.ExitCode != 2 || result.Err == nil {
+			t.Errorf("expected exit code 2 and an error. Got %d, %v", result.ExitCode, result.Err)
+		}
+	})
+}
+
+func TestProdRunner_Rename(t *testing.T) {
+	startDir, _ := os.Getwd()
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: new(bytes.Buffer),
+	}
+
+	t.Run("should move a placeholder into the cwd", func(t *testing.T) {
+		placeholder := Placeholder("abc")
+		expectedPath := filepath.Join(startDir, "renamed.txt")
+		defer os.Remove(expectedPath)
+
+		runner.Rename("rename", placeholder, "//CWD/renamed.txt")
+
+		contents, err := ioutil.ReadFile(expectedPath)
+		if err != nil {
+			t.Fatalf("failed to read renamed file: %v", err)
+		}
+		if string(contents) != "abc" {
+			t.Fatalf("expected contents %q. Got %q", "abc", contents)
+		}
+	})
+}
+
+func TestProdRunner_Chdir(t *testing.T) {
+	startDir, _ := os.Getwd()
+	defer os.Chdir(startDir)
+
+	echoPath := buildTestBinary(t, "echo")
+	defer os.RemoveAll(echoPath)
+
+	if err := os.MkdirAll("testdata_out", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("testdata_out")
+
+	t.Run("should resolve cwd paths against the new cwd", func(t *testing.T) {
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			startDir:   startDir,
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+		}
+		runner.Chdir("//testdata_out")
+		runner.Run("", Step{Command: []string{"//" + echoPath, "//CWD/file.txt"}})
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step output: %v", err)
+		}
+		expected := filepath.Join(startDir, "testdata_out", "file.txt")
+		if log.StepResult.Stdout != expected {
+			t.Errorf("expected %q. Got %q", expected, log.StepResult.Stdout)
+		}
+	})
+}
+
+func TestProdRunner_AssertExists(t *testing.T) {
+	startDir, _ := os.Getwd()
+	var stepOutput bytes.Buffer
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: &stepOutput,
+	}
+
+	t.Run("should pass and log the assertion if the path exists", func(t *testing.T) {
+		if err := ioutil.WriteFile("exists.txt", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove("exists.txt")
+
+		err := recoverFatal(func() {
+			runner.AssertExists("//CWD/exists.txt")
+		})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step output: %v", err)
+		}
+		expected := []string{assertExistsCommand, filepath.Join(startDir, "exists.txt")}
+		if !reflect.DeepEqual(expected, log.Step.Command) {
+			t.Errorf("expected command %v. Got %v", expected, log.Step.Command)
+		}
+	})
+
+	t.Run("should error if the path does not exist", func(t *testing.T) {
+		err := recoverFatal(func() {
+			runner.AssertExists("//CWD/missing.txt")
+		})
+		if err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+}
+
+func TestProdRunner_AssertExistsRelative(t *testing.T) {
+	startDir, _ := os.Getwd()
+	var stepOutput bytes.Buffer
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: &stepOutput,
+	}
+
+	t.Run("should pass and log the assertion if the path exists", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		if err := ioutil.WriteFile("testdata_out/file.txt", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err := recoverFatal(func() {
+			runner.AssertExistsRelative("//CWD/testdata_out", "file.txt")
+		})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step output: %v", err)
+		}
+		expected := []string{assertExistsCommand, filepath.Join(startDir, "testdata_out", "file.txt")}
+		if log.StepName != "assert_exists" || !reflect.DeepEqual(expected, log.Step.Command) {
+			t.Errorf("expected step %q with command %v. Got %q with %v", "assert_exists", expected, log.StepName, log.Step.Command)
+		}
+	})
+
+	t.Run("should error if the path does not exist", func(t *testing.T) {
+		err := recoverFatal(func() {
+			runner.AssertExistsRelative("//CWD/", "missing.txt")
+		})
+		if err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+}
+
+func TestProdRunner_AssertOutputOrder(t *testing.T) {
+	touchPath := buildTestBinary(t, "touch")
+	defer os.RemoveAll(touchPath)
+
+	if err := os.MkdirAll("testdata_out", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("testdata_out")
+
+	startDir, _ := os.Getwd()
+	var stepOutput bytes.Buffer
+	runner := &prodRunner{
+		startDir:          startDir,
+		stdout:            new(bytes.Buffer),
+		stderr:            os.Stderr,
+		stepOutput:        &stepOutput,
+		recordOutputTimes: true,
+	}
+	for _, name := range []string{"data.txt", "manifest.txt"} {
+		runner.Run(name, Step{
+			Command: []string{"./" + touchPath, "testdata_out/" + name},
+			Outputs: []string{"//CWD/testdata_out/" + name},
+		})
+	}
+
+	t.Run("should record output times when requested", func(t *testing.T) {
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step output: %v", err)
+		}
+		if len(log.OutputTimes) != 1 {
+			t.Errorf("expected one output time. Got %v", log.OutputTimes)
+		}
+	})
+
+	t.Run("should pass if the outputs were produced in order", func(t *testing.T) {
+		err := recoverFatal(func() {
+			runner.AssertOutputOrder("//CWD/testdata_out/data.txt", "//CWD/testdata_out/manifest.txt")
+		})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should error if the outputs were produced out of order", func(t *testing.T) {
+		earlier := time.Now().Add(-time.Hour)
+		if err := os.Chtimes("testdata_out/manifest.txt", earlier, earlier); err != nil {
+			t.Fatal(err)
+		}
+
+		err := recoverFatal(func() {
+			runner.AssertOutputOrder("//CWD/testdata_out/data.txt", "//CWD/testdata_out/manifest.txt")
+		})
+		if err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+}
+
+func TestTestRunner_AssertOutputOrder(t *testing.T) {
+	runner := &testRunner{}
+	runner.Run("data", Step{Outputs: []string{"//CWD/data.txt"}})
+	runner.Run("manifest", Step{Outputs: []string{"//CWD/manifest.txt"}})
+
+	t.Run("should not warn if the outputs were declared in order", func(t *testing.T) {
+		runner.warnings = nil
+		runner.AssertOutputOrder("//CWD/data.txt", "//CWD/manifest.txt")
+
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+	})
+
+	t.Run("should warn if the outputs were declared out of order", func(t *testing.T) {
+		runner.warnings = nil
+		runner.AssertOutputOrder("//CWD/manifest.txt", "//CWD/data.txt")
+
+		if len(runner.warnings) != 1 {
+			t.Errorf("expected a warning. Got %v", runner.warnings)
+		}
+	})
+
+	t.Run("should not record output times", func(t *testing.T) {
+		if times := runner.stepLogs[0].OutputTimes; times != nil {
+			t.Errorf("expected no output times. Got %v", times)
+		}
+	})
+}
+
+func TestTestRunner_RunWithStdin(t *testing.T) {
+	t.Run("should record the contents of stdin", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.RunWithStdin("cat", Step{Command: []string{"cat"}}, strings.NewReader("input"))
+
+		if runner.stepLogs[0].Stdin != "input" {
+			t.Errorf("expected stdin %q. Got %q", "input", runner.stepLogs[0].Stdin)
+		}
+	})
+}
+
+func TestPlaceholder(t *testing.T) {
+	t.Run("should create unique placeholders concurrently", func(t *testing.T) {
+		const count = 50
+		refs := make([]string, count)
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				refs[i] = Placeholder(fmt.Sprint(i))
+			}(i)
+		}
+		wg.Wait()
+
+		ids := make(map[string]bool)
+		paths := make(map[string]bool)
+		for _, ref := range refs {
+			ids[ref] = true
+			paths[PlaceholderPath(placeholderID(ref))] = true
+		}
+		if len(ids) != count || len(paths) != count {
+			t.Errorf("expected %d distinct placeholders. Got %d IDs and %d paths",
+				count, len(ids), len(paths))
+		}
+	})
+
+	t.Run("should resolve a directory placeholder to its directory", func(t *testing.T) {
+		dir := DirectoryPlaceholder()
+		path := PlaceholderPath(placeholderID(dir))
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			t.Fatalf("expected %s to be a directory. Got %v", path, err)
+		}
+
+		args := []string{dir + "/out.txt"}
+		if err := (&prodRunner{}).convertAnyPaths(args); err != nil {
+			t.Fatal(err)
+		}
+		if expected := filepath.Join(path, "out.txt"); args[0] != expected {
+			t.Errorf("expected %q. Got %q", expected, args[0])
+		}
+	})
+}
+
+func TestReadPlaceholder(t *testing.T) {
+	t.Run("should read a placeholder by reference or ID", func(t *testing.T) {
+		placeholder := Placeholder("contents")
+		for _, ref := range []string{placeholder, placeholderID(placeholder)} {
+			contents, err := ReadPlaceholder(ref)
+			if err != nil {
+				t.Fatalf("expected no error for %q. Got %v", ref, err)
+			}
+			if contents != "contents" {
+				t.Errorf("expected %q for %q. Got %q", "contents", ref, contents)
+			}
+		}
+	})
+
+	t.Run("should read binary contents unchanged", func(t *testing.T) {
+		expected := []byte{0xff, 0xfe, 0x00, 0x80, '\n'}
+		contents, err := ReadPlaceholderBytes(PlaceholderBytes(expected))
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		if !bytes.Equal(expected, contents) {
+			t.Errorf("expected %v. Got %v", expected, contents)
+		}
+	})
+
+	t.Run("should error for an unknown placeholder", func(t *testing.T) {
+		if _, err := ReadPlaceholder("//ph/unknown"); err == nil {
+			t.Errorf("expected an error. Got nil")
+		}
+	})
+}
+
+func TestTestRunner_PlaceholderContents(t *testing.T) {
+	// A recipe helper that writes a version file.
+	writeVersion := func(r Runner, placeholder string) {
+		path := PlaceholderPath(strings.TrimPrefix(placeholder, "//ph/"))
+		if err := ioutil.WriteFile(path, []byte("1.2.3"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r.Run("use version", Step{Command: []string{"cat", placeholder}})
+	}
+
+	t.Run("should return the contents written to a placeholder", func(t *testing.T) {
+		runner := &testRunner{}
+		placeholder := Placeholder("")
+		writeVersion(runner, placeholder)
+
+		if contents := runner.PlaceholderContents(placeholder); string(contents) != "1.2.3" {
+			t.Errorf("expected contents %q. Got %q", "1.2.3", contents)
+		}
+	})
+
+	t.Run("should accept a placeholder ID", func(t *testing.T) {
+		runner := &testRunner{}
+		placeholder := Placeholder("contents")
+		id := strings.TrimPrefix(placeholder, "//ph/")
+
+		if contents := runner.PlaceholderContents(id); string(contents) != "contents" {
+			t.Errorf("expected contents %q. Got %q", "contents", contents)
+		}
+	})
+
+	t.Run("should prefer virtual contents", func(t *testing.T) {
+		placeholder := Placeholder("on disk")
+		runner := &testRunner{contents: map[string][]byte{
+			placeholder: []byte("virtual"),
+		}}
+
+		if contents := runner.PlaceholderContents(placeholder); string(contents) != "virtual" {
+			t.Errorf("expected contents %q. Got %q", "virtual", contents)
+		}
+	})
+}
+
+func TestTestRunner_Timeout(t *testing.T) {
+	t.Run("should record but not enforce timeouts", func(t *testing.T) {
+		runner := &testRunner{}
+		result := runner.Run("sleep", Step{Command: []string{"sleep", "10"}, Timeout: time.Second})
+
+		if result.ExitCode != 0 {
+			t.Errorf("expected exit code 0. Got %d", result.ExitCode)
+		}
+		if runner.stepLogs[0].Step.Timeout != time.Second {
+			t.Errorf("expected timeout %v. Got %v", time.Second, runner.stepLogs[0].Step.Timeout)
+		}
+	})
+}
+
+func TestTestRunner_Stdin(t *testing.T) {
+	t.Run("should record step stdin", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("cat", Step{Command: []string{"cat"}, Stdin: "input"})
+
+		if runner.stepLogs[0].Stdin != "input" {
+			t.Errorf("expected stdin %q. Got %q", "input", runner.stepLogs[0].Stdin)
+		}
+	})
+}
+
+func TestTestRunner_NonZeroExit(t *testing.T) {
+	mocks := []Mock{{Step: "fail", Result: StepResult{ExitCode: 1}}}
+
+	t.Run("should warn if a step that must succeed exits with a non-zero code", func(t *testing.T) {
+		runner := &testRunner{Mocks: mocks}
+		runner.Run("fail", Step{Command: []string{"false"}, FailOnNonZeroExit: true})
+
+		if len(runner.warnings) != 1 {
+			t.Errorf("expected a warning. Got %v", runner.warnings)
+		}
+	})
+
+	t.Run("should not warn about a non-zero exit by default", func(t *testing.T) {
+		runner := &testRunner{Mocks: mocks}
+		runner.Run("fail", Step{Command: []string{"false"}})
+
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+	})
+
+	t.Run("should return an error instead of warning from TryRun", func(t *testing.T) {
+		runner := &testRunner{Mocks: mocks}
+		result, err := runner.TryRun("fail", Step{Command: []string{"false"}, FailOnNonZeroExit: true})
+
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+		if result.ExitCode != 1 {
+			t.Errorf("expected exit code 1. Got %d", result.ExitCode)
+		}
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+	})
+}
+
+func TestRecordingWriter_Max(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		expected string
+	}{
+		{"under the cap", []string{"ab", "c"}, "abc"},
+		{"exactly at the cap", []string{"ab", "cd"}, "abcd"},
+		{"over the cap", []string{"ab", "cde"}, "abcd...[truncated 1 bytes]"},
+		{"after the cap", []string{"abcd", "ef", "g"}, "abcd...[truncated 3 bytes]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streamed bytes.Buffer
+			w := &recordingWriter{Delegate: &streamed, Max: 4}
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("expected to write %d bytes. Got %d, %v", len(s), n, err)
+				}
+			}
+
+			if w.String() != tt.expected {
+				t.Errorf("expected %q. Got %q", tt.expected, w.String())
+			}
+			if streamed.String() != strings.Join(tt.writes, "") {
+				t.Errorf("expected all output to be streamed. Got %q", streamed.String())
+			}
+		})
+	}
+}
+
+func TestTestRunner_MaxOutputBytes(t *testing.T) {
+	runner := &testRunner{Mocks: []Mock{{
+		Step:   "chatty",
+		Result: StepResult{Stdout: "abcdef", Stderr: "ab"},
+	}}}
+	result := runner.Run("chatty", Step{Command: []string{"chatty"}, MaxOutputBytes: 4})
+
+	if result.Stdout != "abcd...[truncated 2 bytes]" || result.Stderr != "ab" {
+		t.Errorf("expected stdout to be truncated. Got %q, %q", result.Stdout, result.Stderr)
+	}
+}
+
+func TestTestRunner_FailedOutputs(t *testing.T) {
+	t.Run("should not declare the outputs of a failed step", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{Step: "fail", Result: StepResult{ExitCode: 1}}}}
+		runner.Run("fail", Step{Outputs: []string{"//CWD/out.txt"}})
+
+		if runner.exists("//CWD/out.txt") {
+			t.Errorf("expected //CWD/out.txt not to exist")
+		}
+	})
+}
+
+func TestTestRunner_Chdir(t *testing.T) {
+	t.Run("should resolve cwd paths against the simulated cwd", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Chdir("//CWD/out")
+		runner.Chdir("sub")
+		runner.Run("cat", Step{Command: []string{"cat", "//CWD/file.txt"}})
+
+		expected := []string{"cat", "[START_DIR]/out/sub/file.txt"}
+		if actual := runner.stepLogs[0].Step.Command; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected command %v. Got %v", expected, actual)
+		}
+	})
+
+	t.Run("should resolve cwd paths against the start dir after returning to it", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Chdir("//CWD/out")
+		runner.Chdir("//")
+		runner.Run("cat", Step{Command: []string{"cat", "//CWD/file.txt"}})
+
+		expected := []string{"cat", "[START_DIR]/file.txt"}
+		if actual := runner.stepLogs[0].Step.Command; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected command %v. Got %v", expected, actual)
+		}
+	})
+}
+
+func TestTestRunner_LogFiles(t *testing.T) {
+	t.Run("should record log files in the expectation", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("build", Step{
+				Command:  []string{"make"},
+				LogFiles: map[string]string{"build": "//CWD/build.log"},
+			})
+		}, TestCase{})
+
+		var expectation bytes.Buffer
+		if err := encodeExpectation(&expectation, runner.stepLogs); err != nil {
+			t.Fatal(err)
+		}
+		var logs []StepLog
+		if err := json.Unmarshal(expectation.Bytes(), &logs); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{"build": "[START_DIR]/build.log"}
+		if actual := logs[0].Step.LogFiles; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected log files %v. Got %v", expected, actual)
+		}
+		if actual := runner.summary.LogFiles["build"]; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected summary log files %v. Got %v", expected, actual)
+		}
+	})
+}
+
+func TestTestRunner_HashOutputs(t *testing.T) {
+	t.Run("should record digests of mocked contents", func(t *testing.T) {
+		runner := &testRunner{
+			hashOutputs: true,
+			Mocks: []Mock{{
+				Step:     "write",
+				Contents: map[string]string{"//CWD/out.txt": "abc"},
+			}},
+		}
+		runner.Run("write", Step{Outputs: []string{"//CWD/out.txt"}})
+
+		expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+		if digest := runner.stepLogs[0].OutputDigests["[START_DIR]/out.txt"]; digest != expected {
+			t.Errorf("expected digest %q. Got %q", expected, digest)
+		}
+	})
+
+	t.Run("should not record digests unless requested", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:     "write",
+			Contents: map[string]string{"//CWD/out.txt": "abc"},
+		}}}
+		runner.Run("write", Step{Outputs: []string{"//CWD/out.txt"}})
+
+		if digests := runner.stepLogs[0].OutputDigests; digests != nil {
+			t.Errorf("expected no digests. Got %v", digests)
+		}
+	})
+}
+
+func TestTestRunner_AssertExists(t *testing.T) {
+	t.Run("should not warn if the path was declared", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("touch", Step{Outputs: []string{"//CWD/file.txt"}})
+		runner.AssertExists("//CWD/file.txt")
+
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+		expected := StepLog{
+			StepName: "assert_exists",
+			Step:     Step{Command: []string{assertExistsCommand, "[START_DIR]/file.txt"}},
+		}
+		expectLogsEqual(t, expected, runner.stepLogs[1])
+	})
+
+	t.Run("should warn if the path was not declared", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.AssertExists("//CWD/missing.txt")
+
+		if len(runner.warnings) != 1 {
+			t.Errorf("expected a warning. Got %v", runner.warnings)
+		}
+	})
+}
+
+func TestTestRunner_UndeclaredReads(t *testing.T) {
+	t.Run("should warn if a command reads an undeclared path", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("cat", Step{Command: []string{"cat", "//CWD/in.txt"}})
+
+		if len(runner.warnings) != 1 {
+			t.Errorf("expected a warning. Got %v", runner.warnings)
+		}
+	})
+
+	t.Run("should not warn once a previous step declares the path", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("touch", Step{
+			Command: []string{"touch", "//CWD/out/in.txt"},
+			Outputs: []string{"//CWD/out/"},
+		})
+		runner.Run("cat", Step{Command: []string{"cat", "//CWD/out/in.txt", "-n"}})
+
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+	})
+}
+
+func TestTestRunner_AssertExistsRelative(t *testing.T) {
+	t.Run("should not warn if the path was declared", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("touch", Step{Outputs: []string{"//CWD/out/file.txt"}})
+		runner.AssertExistsRelative("//CWD/out", "file.txt")
+
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+		log := runner.stepLogs[len(runner.stepLogs)-1]
+		expected := []string{assertExistsCommand, "[START_DIR]/out/file.txt"}
+		if log.StepName != "assert_exists" || !reflect.DeepEqual(expected, log.Step.Command) {
+			t.Errorf("expected step %q with command %v. Got %q with %v", "assert_exists", expected, log.StepName, log.Step.Command)
+		}
+	})
+
+	t.Run("should not warn if the path was created by a mock", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:    "unpack",
+			Creates: []string{"//CWD/out/", "//CWD/out/sub/a.txt"},
+		}}}
+		runner.Run("unpack", Step{})
+		runner.AssertExistsRelative("//CWD/", "out")
+		runner.AssertExistsRelative("//CWD/out", "sub")
+		runner.AssertExistsRelative("//CWD/out/sub", "a.txt")
+
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+	})
+
+	t.Run("should warn if the path was not declared", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.AssertExistsRelative("//CWD/", "missing.txt")
+
+		if len(runner.warnings) != 1 {
+			t.Errorf("expected a warning. Got %v", runner.warnings)
+		}
+	})
+}
+
+func TestProdRunner_ListDir(t *testing.T) {
+	startDir, _ := os.Getwd()
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: new(bytes.Buffer),
+	}
+
+	t.Run("should list the entries in a directory", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out/sub", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		if err := ioutil.WriteFile("testdata_out/b.txt", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile("testdata_out/a.txt", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"a.txt", "b.txt", "sub"}
+		actual := runner.ListDir("//CWD/testdata_out")
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %v. Got %v", expected, actual)
+		}
+	})
+
+	t.Run("should error if the directory does not exist", func(t *testing.T) {
+		err := recoverFatal(func() {
+			runner.ListDir("//CWD/missing")
+		})
+		if err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+}
+
+func TestProdRunner_Stat(t *testing.T) {
+	startDir, _ := os.Getwd()
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: new(bytes.Buffer),
+	}
+
+	t.Run("should describe an existing file", func(t *testing.T) {
+		if err := os.MkdirAll("testdata_out", 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll("testdata_out")
+		if err := ioutil.WriteFile("testdata_out/a.txt", []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Ignore the umask.
+		if err := os.Chmod("testdata_out/a.txt", 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		info, ok := runner.Stat("//CWD/testdata_out/a.txt")
+		expected := FileInfoLite{Name: "a.txt", Size: 3, Mode: 0644}
+		if !ok || info != expected {
+			t.Errorf("expected %+v. Got %+v, %v", expected, info, ok)
+		}
+		if info, ok := runner.Stat("//CWD/testdata_out"); !ok || !info.IsDir {
+			t.Errorf("expected a directory. Got %+v, %v", info, ok)
+		}
+	})
+
+	t.Run("should report a missing file", func(t *testing.T) {
+		if info, ok := runner.Stat("//CWD/missing"); ok {
+			t.Errorf("expected the file not to exist. Got %+v", info)
+		}
+	})
+}
+
+func TestTestRunner_Stat(t *testing.T) {
+	t.Run("should describe declared outputs", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:     "write",
+			Contents: map[string]string{"//out/a.txt": "abc"},
+		}}}
+		runner.Run("write", Step{})
+		runner.Run("build", Step{Outputs: []string{"//out/bin/tool"}})
+
+		if info, ok := runner.Stat("//out/a.txt"); !ok || info != (FileInfoLite{Name: "a.txt", Size: 3}) {
+			t.Errorf("expected a 3 byte file. Got %+v, %v", info, ok)
+		}
+		if info, ok := runner.Stat("//out/bin/"); !ok || info != (FileInfoLite{Name: "bin", IsDir: true}) {
+			t.Errorf("expected a directory. Got %+v, %v", info, ok)
+		}
+	})
+
+	t.Run("should report an undeclared path as missing", func(t *testing.T) {
+		runner := &testRunner{}
+		if info, ok := runner.Stat("//out/a.txt"); ok {
+			t.Errorf("expected the file not to exist. Got %+v", info)
+		}
+	})
+}
+
+func TestProdRunner_ReadFile(t *testing.T) {
+	startDir, _ := os.Getwd()
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: new(bytes.Buffer),
+	}
+
+	t.Run("should read a file", func(t *testing.T) {
+		if err := ioutil.WriteFile("VERSION", []byte("1.2.3"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove("VERSION")
+
+		contents, err := runner.ReadFile("//VERSION")
+		if err != nil || string(contents) != "1.2.3" {
+			t.Errorf("expected the file's contents. Got %q, %v", contents, err)
+		}
+	})
+
+	t.Run("should error if the file does not exist", func(t *testing.T) {
+		if _, err := runner.ReadFile("//missing"); !os.IsNotExist(err) {
+			t.Errorf("expected a not exist error. Got %v", err)
+		}
+	})
+}
+
+func TestTestRunner_ReadFile(t *testing.T) {
+	t.Run("should read a mocked output", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:     "version",
+			Contents: map[string]string{"//out/VERSION": "1.2.3"},
+		}}}
+		runner.Run("version", Step{Outputs: []string{"//out/VERSION"}})
+
+		contents, err := runner.ReadFile("//out/VERSION")
+		if err != nil || string(contents) != "1.2.3" {
+			t.Errorf("expected the mocked contents. Got %q, %v", contents, err)
+		}
+	})
+
+	t.Run("should error if no contents were mocked", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("version", Step{Outputs: []string{"//out/VERSION"}})
+
+		if _, err := runner.ReadFile("//out/VERSION"); err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+}
+
+func TestProdRunner_WriteFile(t *testing.T) {
+	startDir, _ := os.Getwd()
+	var stepOutput bytes.Buffer
+	runner := &prodRunner{
+		startDir:   startDir,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stepOutput: &stepOutput,
+	}
+
+	defer os.Remove("VERSION")
+	runner.WriteFile("//VERSION", []byte("1.2.3"))
+
+	if contents, err := ioutil.ReadFile("VERSION"); err != nil || string(contents) != "1.2.3" {
+		t.Errorf("expected the file to be written. Got %q, %v", contents, err)
+	}
+	var log StepLog
+	if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+		t.Fatalf("failed to decode step log: %v", err)
+	}
+	path := filepath.Join(startDir, "VERSION")
+	expected := StepLog{
+		StepName: "write_file",
+		Step:     Step{Command: []string{writeFileCommand, path}, Outputs: []string{path}},
+	}
+	expectLogsEqual(t, expected, log)
+}
+
+func TestTestRunner_WriteFile(t *testing.T) {
+	t.Run("should make the written file readable", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.WriteFile("//out/VERSION", []byte("1.2.3"))
+		runner.AssertExists("//out/VERSION")
+
+		contents, err := runner.ReadFile("//out/VERSION")
+		if err != nil || string(contents) != "1.2.3" {
+			t.Errorf("expected the written contents. Got %q, %v", contents, err)
+		}
+		if len(runner.warnings) > 0 {
+			t.Errorf("expected no warnings. Got %v", runner.warnings)
+		}
+		if log := runner.stepLogs[0]; log.StepName != "write_file" || len(log.Step.Outputs) != 1 {
+			t.Errorf("expected a write_file step declaring the output. Got %+v", log)
+		}
+	})
+
+	t.Run("should warn on an absolute path", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.WriteFile("/tmp/VERSION", []byte("1.2.3"))
+
+		if len(runner.warnings) != 1 {
+			t.Errorf("expected a warning. Got %v", runner.warnings)
+		}
+	})
+}
+
+func TestTestRunner_ListDir(t *testing.T) {
+	t.Run("should list declared and mock-created entries", func(t *testing.T) {
+		dir := Placeholder("")
+		runner := &testRunner{Mocks: []Mock{{
+			Step:    "unpack",
+			Creates: []string{dir + "/sub/c.txt"},
+		}}}
+		runner.Run("write", Step{Outputs: []string{dir + "/b.txt", dir + "/a.txt"}})
+		runner.Run("unpack", Step{})
+
+		expected := []string{"a.txt", "b.txt", "sub"}
+		actual := runner.ListDir(dir)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %v. Got %v", expected, actual)
+		}
+	})
+
+	t.Run("should list nothing for an undeclared directory", func(t *testing.T) {
+		runner := &testRunner{}
+		if actual := runner.ListDir("//CWD/missing"); len(actual) > 0 {
+			t.Errorf("expected no entries. Got %v", actual)
+		}
+	})
+}
+
+func TestTestRunner_Rename(t *testing.T) {
+	t.Run("should declare the new path as an output", func(t *testing.T) {
+		runner := &testRunner{}
+		placeholder := Placeholder("abc")
+		runner.Rename("rename", placeholder, "//CWD/renamed.txt")
+
+		if !runner.exists("//CWD/renamed.txt") {
+			t.Fatalf("expected %q to be declared", "//CWD/renamed.txt")
+		}
+
+		expected := StepLog{
+			StepName: "rename",
+			Step: Step{
+				Command: []string{renameCommand, simulatedPath(placeholder), "[START_DIR]/renamed.txt"},
+				Outputs: []string{"[START_DIR]/renamed.txt"},
+			},
+		}
+		expectLogsEqual(t, expected, runner.stepLogs[0])
+	})
+
+	t.Run("should undeclare the old path", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("touch", Step{Outputs: []string{"//CWD/a.txt"}})
+		runner.Rename("rename", "//CWD/a.txt", "//CWD/b.txt")
+
+		if runner.exists("//CWD/a.txt") {
+			t.Fatalf("expected %q to be undeclared", "//CWD/a.txt")
+		}
+	})
+}
+
+func TestTestRunner_MockCommand(t *testing.T) {
+	t.Run("should match a mock by name and command", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{
+			{Step: "build", Command: []string{"make", "all"}, Result: StepResult{Stdout: "all"}},
+			{Step: "build", Command: []string{"make", "test"}, Result: StepResult{Stdout: "test"}},
+		}}
+
+		if result := runner.Run("build", Step{Command: []string{"make", "test"}}); result.Stdout != "test" {
+			t.Errorf("expected stdout %q. Got %q", "test", result.Stdout)
+		}
+	})
+
+	t.Run("should match a mock by name alone if it has no command", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{Step: "build", Result: StepResult{Stdout: "any"}}}}
+
+		if result := runner.Run("build", Step{Command: []string{"make", "test"}}); result.Stdout != "any" {
+			t.Errorf("expected stdout %q. Got %q", "any", result.Stdout)
+		}
+	})
+
+	t.Run("should not match a mock with a different command", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:    "build",
+			Command: []string{"make", "all"},
+			Result:  StepResult{Stdout: "all"},
+		}}}
+
+		if result := runner.Run("build", Step{Command: []string{"make", "test"}}); result.Stdout != "" {
+			t.Errorf("expected no stdout. Got %q", result.Stdout)
+		}
+		if len(runner.Mocks) != 1 {
+			t.Errorf("expected the mock to remain unused")
+		}
+	})
+}
+
+func TestTestRunner_MockMatcher(t *testing.T) {
+	matcher := Step{Dir: "//out", Env: map[string]string{"GOOS": "linux"}}
+	step := Step{
+		Command: []string{"go", "build"},
+		Dir:     "//out",
+		Env:     map[string]string{"GOOS": "linux"},
+	}
+
+	t.Run("should treat unset matcher fields as wildcards", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:    "build",
+			Matcher: matcher,
+			Result:  StepResult{Stdout: "matched"},
+		}}}
+
+		if result := runner.Run("build", step); result.Stdout != "matched" {
+			t.Errorf("expected stdout %q. Got %q", "matched", result.Stdout)
+		}
+	})
+
+	t.Run("should not match a step whose set fields differ", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:    "build",
+			Matcher: Step{Dir: "//out", Env: map[string]string{"GOOS": "windows"}},
+			Result:  StepResult{Stdout: "matched"},
+		}}}
+
+		if result := runner.Run("build", step); result.Stdout != "" {
+			t.Errorf("expected no stdout. Got %q", result.Stdout)
+		}
+	})
+
+	t.Run("should require unset matcher fields to be zero if strict", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:       "build",
+			Matcher:    matcher,
+			StrictZero: true,
+			Result:     StepResult{Stdout: "matched"},
+		}}}
+
+		if result := runner.Run("build", step); result.Stdout != "" {
+			t.Errorf("expected no stdout for a step with a command. Got %q", result.Stdout)
+		}
+		if result := runner.Run("build", matcher); result.Stdout != "matched" {
+			t.Errorf("expected stdout %q. Got %q", "matched", result.Stdout)
+		}
+	})
+}
+
+func TestTestRunner_MultipleMatchingMocks(t *testing.T) {
+	mocks := []Mock{
+		{Step: "build", Result: StepResult{Stdout: "first"}},
+		{NamePattern: "bui.*", Result: StepResult{Stdout: "second"}},
+	}
+
+	t.Run("should use the earliest mock by default", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("build", Step{Command: []string{"make"}})
+		}, TestCase{Mocks: mocks})
+
+		if stdout := runner.stepLogs[0].StepResult.Stdout; stdout != "first" {
+			t.Errorf("expected stdout %q. Got %q", "first", stdout)
+		}
+	})
+
+	t.Run("should fail if strict", func(t *testing.T) {
+		err := recoverFatal(func() {
+			runTest(func(r Runner) {
+				r.Run("build", Step{Command: []string{"make"}})
+			}, TestCase{Mocks: mocks, StrictMocks: true})
+		})
+		if err == nil || !strings.Contains(err.Error(), "ambiguous mocks") {
+			t.Errorf("expected an ambiguous mocks error. Got %v", err)
+		}
+	})
+
+	t.Run("should return the error from TestConfig.Run if strict", func(t *testing.T) {
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("build", Step{Command: []string{"make"}})
+		}}
+		err := cfg.Run(TestCase{Name: "ambiguous", Mocks: mocks, StrictMocks: true, SuppressLogs: true})
+		if _, ok := err.(*ChowError); !ok || !strings.Contains(err.Error(), "ambiguous mocks") {
+			t.Errorf("expected an ambiguous mocks error. Got %v", err)
+		}
+	})
+
+	t.Run("should not fail if strict and a single mock remains", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("build", Step{Command: []string{"make"}})
+			r.Run("build", Step{Command: []string{"make"}})
+		}, TestCase{
+			Mocks: []Mock{
+				{Step: "build", Times: 1, Result: StepResult{Stdout: "first"}},
+				{NamePattern: "build 1", Result: StepResult{Stdout: "second"}},
+			},
+			StrictMocks: true,
+		})
+
+		if stdout := runner.stepLogs[1].StepResult.Stdout; stdout != "second" {
+			t.Errorf("expected stdout %q. Got %q", "second", stdout)
+		}
+	})
+}
+
+func TestTestConfig_UnusedMocks(t *testing.T) {
+	cfg := TestConfig{Runnable: func(r Runner) {
+		r.Run("build", Step{Command: []string{"make"}})
+		r.Run("test", Step{Command: []string{"make", "test"}})
+	}}
+
+	t.Run("should pass if every mock matches a step", func(t *testing.T) {
+		err := cfg.Run(TestCase{
+			Name:         "used",
+			Mocks:        []Mock{{Step: "build"}, {NamePattern: "te.*", Times: 1}},
+			SuppressLogs: true,
+		})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should list mocks that match no step", func(t *testing.T) {
+		err := cfg.Run(TestCase{
+			Name:         "unused",
+			Mocks:        []Mock{{Step: "build"}, {Step: "biuld"}, {NamePattern: "lint.*"}},
+			SuppressLogs: true,
+		})
+		if err == nil || !strings.Contains(err.Error(), `"biuld", pattern "lint.*"`) {
+			t.Errorf("expected an error listing the unused mocks. Got %v", err)
+		}
+	})
+
+	t.Run("should allow unused mocks if requested", func(t *testing.T) {
+		err := cfg.Run(TestCase{
+			Name:             "allowed",
+			Mocks:            []Mock{{Step: "biuld"}},
+			AllowUnusedMocks: true,
+			SuppressLogs:     true,
+		})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+}
+
+func TestTestRunner_MockTimes(t *testing.T) {
+	stdouts := func(mock Mock) []string {
+		runner := &testRunner{Mocks: []Mock{mock}}
+		var stdouts []string
+		for i := 0; i < 3; i++ {
+			stdouts = append(stdouts, runner.Run("build", Step{}).Stdout)
+		}
+		return stdouts
+	}
+
+	t.Run("should apply a mock to every invocation", func(t *testing.T) {
+		expected := []string{"ok", "ok", "ok"}
+		actual := stdouts(Mock{Step: "build", Result: StepResult{Stdout: "ok"}})
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %v. Got %v", expected, actual)
+		}
+	})
+
+	t.Run("should apply a mock the given number of times", func(t *testing.T) {
+		expected := []string{"ok", "ok", ""}
+		actual := stdouts(Mock{Step: "build", Times: 2, Result: StepResult{Stdout: "ok"}})
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %v. Got %v", expected, actual)
+		}
+	})
+
+	t.Run("should apply a one-shot mock once", func(t *testing.T) {
+		expected := []string{"ok", "", ""}
+		actual := stdouts(Mock{Step: "build", Times: 1, Result: StepResult{Stdout: "ok"}})
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %v. Got %v", expected, actual)
+		}
+	})
+
+	t.Run("should apply a mock naming a repeated invocation to it alone", func(t *testing.T) {
+		expected := []string{"", "ok", ""}
+		actual := stdouts(Mock{Step: "build 1", Result: StepResult{Stdout: "ok"}})
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %v. Got %v", expected, actual)
+		}
+	})
+}
+
+func TestTestRunner_MockNamePattern(t *testing.T) {
+	t.Run("should match every invocation matching the pattern", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			Step:        "ignored",
+			NamePattern: "compile.*",
+			Result:      StepResult{Stdout: "ok"},
+		}}}
+
+		var stdouts []string
+		for _, name := range []string{"compile", "compile", "compile", "link"} {
+			stdouts = append(stdouts, runner.Run(name, Step{}).Stdout)
+		}
+		expected := []string{"ok", "ok", "ok", ""}
+		if !reflect.DeepEqual(expected, stdouts) {
+			t.Errorf("expected %v. Got %v", expected, stdouts)
+		}
+	})
+
+	t.Run("should count matches towards Times", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{{
+			NamePattern: "compile.*",
+			Times:       2,
+			Result:      StepResult{Stdout: "ok"},
+		}}}
+
+		var stdouts []string
+		for i := 0; i < 3; i++ {
+			stdouts = append(stdouts, runner.Run("compile", Step{}).Stdout)
+		}
+		expected := []string{"ok", "ok", ""}
+		if !reflect.DeepEqual(expected, stdouts) {
+			t.Errorf("expected %v. Got %v", expected, stdouts)
+		}
+	})
+}
+
+func TestTestRunner_MockOutputs(t *testing.T) {
+	catPath := buildTestBinary(t, "cat")
+	defer os.Remove(catPath)
+
+	t.Run("should write mocked outputs to disk until the test finishes", func(t *testing.T) {
+		var read string
+		runner := runTest(func(r Runner) {
+			r.Run("generate", Step{Outputs: []string{"//CWD/mocked/out.txt"}})
+
+			out, err := exec.Command("./"+catPath, filepath.Join("mocked", "out.txt")).Output()
+			if err != nil {
+				t.Fatalf("failed to read mocked output: %v", err)
+			}
+			read = string(out)
+		}, TestCase{Mocks: []Mock{{
+			Step:   "generate",
+			Result: StepResult{Outputs: map[string]string{"//CWD/mocked/out.txt": "generated"}},
+		}}})
+
+		if read != "generated" {
+			t.Errorf("expected %q. Got %q", "generated", read)
+		}
+		if contents := runner.contents["//CWD/mocked/out.txt"]; string(contents) != "generated" {
+			t.Errorf("expected virtual contents %q. Got %q", "generated", contents)
+		}
+		if _, err := os.Stat("mocked"); !os.IsNotExist(err) {
+			t.Errorf("expected mocked outputs to be removed. Got %v", err)
+		}
+	})
+
+	t.Run("should restore files overwritten by mocked outputs", func(t *testing.T) {
+		placeholder := Placeholder("original")
+		runTest(func(r Runner) {
+			r.Run("generate", Step{})
+			if contents, _ := ReadPlaceholder(placeholder); contents != "generated" {
+				t.Errorf("expected %q. Got %q", "generated", contents)
+			}
+		}, TestCase{Mocks: []Mock{{
+			Step:   "generate",
+			Result: StepResult{Outputs: map[string]string{placeholder: "generated"}},
+		}}})
+
+		if contents, _ := ReadPlaceholder(placeholder); contents != "original" {
+			t.Errorf("expected %q. Got %q", "original", contents)
+		}
+	})
+
+	t.Run("should not write mocked outputs outside the working directory", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "outside")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		outside := filepath.Join(dir, "out.txt")
+		runner := runTest(func(r Runner) {
+			r.Run("generate", Step{})
+			if _, err := os.Stat(outside); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to be written. Got %v", outside, err)
+			}
+		}, TestCase{Mocks: []Mock{{
+			Step: "generate",
+			Result: StepResult{Outputs: map[string]string{
+				outside:            "generated",
+				"//HOME/out.txt":   "generated",
+				"//CWD/../out.txt": "generated",
+			}},
+		}}})
+
+		if contents := runner.contents["//HOME/out.txt"]; string(contents) != "generated" {
+			t.Errorf("expected virtual contents %q. Got %q", "generated", contents)
+		}
+		if _, err := os.Stat(filepath.Join("..", "out.txt")); !os.IsNotExist(err) {
+			t.Errorf("expected ../out.txt not to be written. Got %v", err)
+		}
+	})
+}
+
+func TestTestRunner_MockDuration(t *testing.T) {
+	t.Run("should record a mocked duration in the step log", func(t *testing.T) {
+		var output bytes.Buffer
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("slow", Step{Command: []string{"sleep"}})
+			r.Run("fast", Step{Command: []string{"true"}})
+		}}
+		err := cfg.Run(TestCase{
+			Name:   "duration",
+			Output: &output,
+			Mocks:  []Mock{{Step: "slow", Result: StepResult{Duration: 90 * time.Second}}},
+		})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		var logs []StepLog
+		if err := json.Unmarshal(output.Bytes(), &logs); err != nil {
+			t.Fatalf("failed to decode expectation: %v", err)
+		}
+		if logs[0].StepResult.Duration != 90*time.Second {
+			t.Errorf("expected the mocked duration. Got %v", logs[0].StepResult.Duration)
+		}
+		if logs[1].StepResult.Duration != 0 {
+			t.Errorf("expected no duration for an unmocked step. Got %v", logs[1].StepResult.Duration)
+		}
+		if strings.Count(output.String(), `"duration"`) != 1 {
+			t.Errorf("expected the zero duration to be omitted:\n%s", output.String())
+		}
+	})
+}
+
+func TestTestRunner_DefaultResult(t *testing.T) {
+	t.Run("should apply the default result to unmatched steps only", func(t *testing.T) {
+		runner := &testRunner{
+			Mocks:         []Mock{{Step: "build", Result: StepResult{Stdout: "mocked"}}},
+			defaultResult: &StepResult{Stdout: "default"},
+		}
+
+		if result := runner.Run("build", Step{}); result.Stdout != "mocked" {
+			t.Errorf("expected stdout %q. Got %q", "mocked", result.Stdout)
+		}
+		if result := runner.Run("test", Step{}); result.Stdout != "default" {
+			t.Errorf("expected stdout %q. Got %q", "default", result.Stdout)
+		}
+	})
+
+	t.Run("should return an empty result without a default", func(t *testing.T) {
+		runner := &testRunner{}
+		if result := runner.Run("test", Step{}); !reflect.DeepEqual(StepResult{}, result) {
+			t.Errorf("expected an empty result. Got %#v", result)
+		}
+	})
+}
+
+func TestCompose(t *testing.T) {
+	lint := func(r Runner) {
+		r.Run("lint/vet", Step{Command: []string{"go", "vet"}})
+	}
+	build := func(r Runner) {
+		r.Run("build/compile", Step{Command: []string{"go", "build"}})
+		r.Run("build/test", Step{Command: []string{"go", "test"}})
+	}
+
+	runner := runTest(Compose(lint, build), TestCase{})
+	var names []string
+	for _, log := range runner.stepLogs {
+		names = append(names, log.StepName)
+	}
+	expected := []string{"lint/vet", "build/compile", "build/test"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("expected steps %v. Got %v", expected, names)
+	}
+}
+
+func TestTestRunner_RunAll(t *testing.T) {
+	t.Run("should run steps in order with indexed names", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{
+			{Step: "fetch_0", Result: StepResult{Stdout: "a"}},
+			{Step: "fetch_1", Result: StepResult{Stdout: "b"}},
+		}}
+
+		results := runner.RunAll("fetch", []Step{
+			{Command: []string{"fetch", "a"}},
+			{Command: []string{"fetch", "b"}},
+		})
+
+		var names, stdouts []string
+		for i, log := range runner.stepLogs {
+			names = append(names, log.StepName)
+			stdouts = append(stdouts, results[i].Stdout)
+		}
+		if expected := []string{"fetch_0", "fetch_1"}; !reflect.DeepEqual(expected, names) {
+			t.Errorf("expected step names %v. Got %v", expected, names)
+		}
+		if expected := []string{"a", "b"}; !reflect.DeepEqual(expected, stdouts) {
+			t.Errorf("expected stdouts %v. Got %v", expected, stdouts)
+		}
+	})
+
+	t.Run("should prefix the names of steps run in a phase", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Phase("fetch", func(r Runner) {
+			r.RunAll("artifact", []Step{{}})
+		})
+
+		if name := runner.stepLogs[0].StepName; name != "fetch/artifact_0" {
+			t.Errorf("expected step name %q. Got %q", "fetch/artifact_0", name)
+		}
+	})
+}
+
+func TestProdRunner_fork(t *testing.T) {
+	t.Run("should copy the runner's configuration", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		configured := func() *prodRunner {
+			return &prodRunner{
+				startDir:          "/start",
+				stepOutput:        new(bytes.Buffer),
+				recordOnly:        true,
+				verbose:           true,
+				defaultTimeout:    time.Minute,
+				recordEnv:         true,
+				hashOutputs:       true,
+				recordOutputModes: true,
+				recordOutputTimes: true,
+				guardStartDir:     true,
+				parallelism:       3,
+				properties:        `{"name":"value"}`,
+				ctx:               ctx,
+			}
+		}
+		runner := configured()
+		var stdout, stderr bytes.Buffer
+		batch := &batchOutputs{}
+		clone := runner.fork(&stdout, &stderr, batch)
+
+		expected := configured()
+		expected.stdout = &stdout
+		expected.stderr = &stderr
+		expected.parent = runner
+		expected.batchOutputs = batch
+		if !reflect.DeepEqual(expected, clone) {
+			t.Errorf("expected the clone %# v. Got %# v", pretty.Formatter(expected), pretty.Formatter(clone))
+		}
+	})
+
+}
+
+func TestRunParallel(t *testing.T) {
+	// Returns the largest number of calls that ran at once.
+	maxConcurrency := func(n, limit int) int64 {
+		var running, max int64
+		var mu sync.Mutex
+		runParallel(n, limit, func(int) {
+			current := atomic.AddInt64(&running, 1)
+			mu.Lock()
+			if current > max {
+				max = current
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt64(&running, -1)
+		})
+		return max
+	}
+
+	t.Run("should run no more than the limit at once", func(t *testing.T) {
+		if max := maxConcurrency(10, 2); max > 2 {
+			t.Errorf("expected at most 2 concurrent calls. Got %d", max)
+		}
+	})
+
+	t.Run("should not limit concurrency if the limit is zero", func(t *testing.T) {
+		if max := maxConcurrency(10, 0); max < 2 {
+			t.Errorf("expected concurrent calls. Got %d", max)
+		}
+	})
+}
+
+func TestTestRunner_RunParallel(t *testing.T) {
+	t.Run("should record steps in order", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.RunParallel("fetch", []Step{{}, {}, {}})
+
+		var names []string
+		for _, log := range runner.stepLogs {
+			names = append(names, log.StepName)
+		}
+		if expected := []string{"fetch_0", "fetch_1", "fetch_2"}; !reflect.DeepEqual(expected, names) {
+			t.Errorf("expected step names %v. Got %v", expected, names)
+		}
+	})
+}
+
+func TestTestRunner_Properties(t *testing.T) {
+	type properties struct {
+		Target string `json:"target"`
+		Debug  bool   `json:"debug"`
+	}
+	build := func(r Runner) {
+		props := properties{Target: "all"}
+		r.Properties(&props)
+		r.Run("build", Step{Command: []string{"make", props.Target}})
+	}
+
+	t.Run("should pass the test case's properties to the application", func(t *testing.T) {
+		runner := runTest(build, TestCase{Properties: properties{Target: "test"}})
+		if command := runner.stepLogs[0].Step.Command; command[1] != "test" {
+			t.Errorf("expected the target %q. Got %v", "test", command)
+		}
+	})
+
+	t.Run("should keep defaults without properties", func(t *testing.T) {
+		runner := runTest(build, TestCase{})
+		if command := runner.stepLogs[0].Step.Command; command[1] != "all" {
+			t.Errorf("expected the target %q. Got %v", "all", command)
+		}
+	})
+}
+
+func TestRunSummary_RecordStep(t *testing.T) {
+	var summary RunSummary
+	durations := []int{3, 1, 4, 1, 5, 9, 2, 6}
+	for i, d := range durations {
+		summary.recordStep(fmt.Sprint("step", i), StepResult{
+			Duration: time.Duration(d) * time.Second,
+			ExitCode: i % 3,
+		})
+	}
+
+	if summary.Steps != 8 || summary.Failures != 5 || summary.Duration != 31*time.Second {
+		t.Errorf("expected 8 steps, 5 failures and 31s. Got %+v", summary)
+	}
+	expected := []StepSummary{
+		{Name: "step5", Duration: 9 * time.Second, ExitCode: 2},
+		{Name: "step7", Duration: 6 * time.Second, ExitCode: 1},
+		{Name: "step4", Duration: 5 * time.Second, ExitCode: 1},
+		{Name: "step2", Duration: 4 * time.Second, ExitCode: 2},
+		{Name: "step0", Duration: 3 * time.Second, ExitCode: 0},
+	}
+	if !reflect.DeepEqual(expected, summary.SlowestSteps) {
+		t.Errorf("expected slowest steps %v. Got %v", expected, summary.SlowestSteps)
+	}
+}
+
+func TestTestRunner_Group(t *testing.T) {
+	stepNames := func(runner *testRunner) []string {
+		var names []string
+		for _, log := range runner.stepLogs {
+			names = append(names, log.StepName)
+		}
+		return names
+	}
+
+	t.Run("should prefix step names with nested groups", func(t *testing.T) {
+		runner := &testRunner{}
+		build := runner.Group("build")
+		build.Run("configure", Step{})
+		compile := build.Group("compile")
+		compile.Run("cc", Step{})
+		compile.RunAll("link", []Step{{}})
+		compile.Phase("archive", func(r Runner) {
+			r.Run("ar", Step{})
+		})
+
+		expected := []string{
+			"build/configure",
+			"build/compile/cc",
+			"build/compile/link_0",
+			"build/compile/archive/ar",
+		}
+		if names := stepNames(runner); !reflect.DeepEqual(expected, names) {
+			t.Errorf("expected step names %v. Got %v", expected, names)
+		}
+		if len(runner.summary.Phases) != 1 || runner.summary.Phases[0].Name != "build/compile/archive" {
+			t.Errorf("expected a single nested phase. Got %v", runner.summary.Phases)
+		}
+	})
+
+	t.Run("should suffix repeated step names within a group", func(t *testing.T) {
+		runner := &testRunner{}
+		for _, group := range []Runner{runner.Group("lint"), runner.Group("lint")} {
+			group.Run("vet", Step{})
+		}
+		runner.Group("test").Run("vet", Step{})
+
+		expected := []string{"lint/vet", "lint/vet 1", "test/vet"}
+		if names := stepNames(runner); !reflect.DeepEqual(expected, names) {
+			t.Errorf("expected step names %v. Got %v", expected, names)
+		}
+	})
+}
+
+func TestTestRunner_Phase(t *testing.T) {
+	t.Run("should report aggregate durations and namespace steps", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{
+			{Step: "fetch/download", Result: StepResult{Duration: time.Second}},
+			{Step: "build/compile", Result: StepResult{Duration: 2 * time.Second}},
+			{Step: "build/link", Result: StepResult{Duration: 3 * time.Second}},
+		}}
+
+		runner.Phase("fetch", func(r Runner) {
+			r.Run("download", Step{})
+		})
+		runner.Phase("build", func(r Runner) {
+			r.Run("compile", Step{})
+			r.Run("link", Step{})
+		})
+
+		expectedPhases := []PhaseSummary{
+			{Name: "fetch", Duration: time.Second},
+			{Name: "build", Duration: 5 * time.Second},
+		}
+		if !reflect.DeepEqual(expectedPhases, runner.summary.Phases) {
+			t.Errorf("expected phases %v. Got %v", expectedPhases, runner.summary.Phases)
+		}
+
+		var names []string
+		for _, log := range runner.stepLogs {
+			names = append(names, log.StepName)
+		}
+		expectedNames := []string{"fetch/download", "build/compile", "build/link"}
+		if !reflect.DeepEqual(expectedNames, names) {
+			t.Errorf("expected step names %v. Got %v", expectedNames, names)
+		}
+	})
+
+	t.Run("should include nested phases in the enclosing phase", func(t *testing.T) {
+		runner := &testRunner{Mocks: []Mock{
+			{Step: "outer/inner/step", Result: StepResult{Duration: time.Second}},
+		}}
+
+		runner.Phase("outer", func(r Runner) {
+			r.Phase("inner", func(r Runner) {
+				r.Run("step", Step{})
+			})
+		})
+
+		expectedPhases := []PhaseSummary{
+			{Name: "outer/inner", Duration: time.Second},
+			{Name: "outer", Duration: time.Second},
+		}
+		if !reflect.DeepEqual(expectedPhases, runner.summary.Phases) {
+			t.Errorf("expected phases %v. Got %v", expectedPhases, runner.summary.Phases)
+		}
+	})
+}
+
+func TestTestConfig_ExpectWarnings(t *testing.T) {
+	renameUndeclared := func(r Runner) {
+		r.Rename("rename", "//CWD/a.txt", "//CWD/b.txt")
+	}
+
+	t.Run("should pass when the expected warnings are issued", func(t *testing.T) {
+		cfg := TestConfig{Runnable: renameUndeclared}
+		err := cfg.Run(TestCase{
+			Name:           "rename",
+			Output:         new(bytes.Buffer),
+			ExpectWarnings: []string{`renaming undeclared path "//CWD/a.txt"`},
+		})
+		if err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should report a missing expected warning", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("step", Step{})
+
+		err := compareWarnings([]string{"expected warning"}, runner.warnings)
+		if err == nil || !strings.Contains(err.Error(), "expected warning") {
+			t.Errorf("expected an error naming the missing warning. Got %v", err)
+		}
+	})
+
+	t.Run("should report an unexpected warning", func(t *testing.T) {
+		runner := &testRunner{}
+		renameUndeclared(runner)
+
+		err := compareWarnings([]string{}, runner.warnings)
+		if err == nil || !strings.Contains(err.Error(), "undeclared") {
+			t.Errorf("expected an error naming the unexpected warning. Got %v", err)
+		}
+	})
+}
+
+func TestStepLog_JSON(t *testing.T) {
+	t.Run("should omit outputs when a step has none", func(t *testing.T) {
+		b, err := json.Marshal(StepLog{
+			StepName: "step",
+			Step:     Step{Command: []string{"command"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := `{"step_name":"step","step":{"command":["command"]},"result":{"exit_code":0}}`
+		if string(b) != expected {
+			t.Errorf("expected %s. Got %s", expected, b)
+		}
+	})
+
+	t.Run("should decode logs containing empty fields", func(t *testing.T) {
+		input := `{
+			"step_name": "step",
+			"step": {"command": ["command"], "outputs": null},
+			"result": {"stdout": "", "stderr": "", "exit_code": 0}
+		}`
+
+		var actual StepLog
+		if err := json.Unmarshal([]byte(input), &actual); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := StepLog{StepName: "step", Step: Step{Command: []string{"command"}}}
+		expectLogsEqual(t, expected, actual)
+	})
+}
+
+func TestTestConfig_Run(t *testing.T) {
+	t.Run("should write the expectation to the output", func(t *testing.T) {
+		var output bytes.Buffer
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo", "hello"}})
+		}}
+		if err := cfg.Run(TestCase{Name: "echo", Output: &output}); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		var logs []StepLog
+		if err := json.Unmarshal(output.Bytes(), &logs); err != nil {
+			t.Fatalf("failed to decode expectation: %v", err)
+		}
+		if len(logs) != 1 || logs[0].StepName != "echo" {
+			t.Errorf("expected a single echo step. Got %v", logs)
+		}
+	})
+
+	t.Run("should number placeholders independently of earlier test cases", func(t *testing.T) {
+		// Runs a case whose application creates the given number of placeholders.
+		run := func(n int) string {
+			cfg := TestConfig{Runnable: func(r Runner) {
+				for i := 0; i < n; i++ {
+					r.Run("cat", Step{Command: []string{"cat", Placeholder("hello")}})
+				}
+			}}
+			var output bytes.Buffer
+			if err := cfg.Run(TestCase{Name: "cat", Output: &output}); err != nil {
+				t.Fatalf("expected no error. Got %v", err)
+			}
+			return output.String()
+		}
+		first := run(1)
+		run(2)
+		if second := run(1); first != second {
+			t.Errorf("expected the same expectation on every run. Got:\n%s\nand:\n%s", first, second)
+		}
+	})
+
+	t.Run("should keep placeholders created before the run", func(t *testing.T) {
+		placeholder := Placeholder("hello")
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("cat", Step{Command: []string{"cat", placeholder}})
+			if contents := r.PlaceholderContents(placeholder); string(contents) != "hello" {
+				t.Errorf("expected %q. Got %q", "hello", contents)
+			}
+		}}
+		for i := 0; i < 2; i++ {
+			if err := cfg.Run(TestCase{Name: "cat", SuppressLogs: true}); err != nil {
+				t.Fatalf("expected no error on run %d. Got %v", i, err)
+			}
+		}
+	})
+
+	t.Run("should parse the test case's args against the flags", func(t *testing.T) {
+		var target string
+		flags := flag.NewFlagSet("test", flag.ExitOnError)
+		flags.StringVar(&target, "target", "all", "The target to build")
+		cfg := TestConfig{
+			Runnable: func(r Runner) {
+				r.Run("build", Step{Command: []string{"make", target}})
+			},
+			Flags: flags,
+		}
+
+		run := func(args ...string) []string {
+			var logs MemoryLogWriter
+			tc := TestCase{Name: "build", Args: args, SuppressLogs: true, LogWriter: &logs}
+			if err := cfg.Run(tc); err != nil {
+				t.Fatalf("expected no error. Got %v", err)
+			}
+			return logs.Entries[0].Step.Command
+		}
+		if command := run("-target=test"); !reflect.DeepEqual(command, []string{"make", "test"}) {
+			t.Errorf("expected the target from the args. Got %v", command)
+		}
+		if command := run(); !reflect.DeepEqual(command, []string{"make", "all"}) {
+			t.Errorf("expected the default target without args. Got %v", command)
+		}
+	})
+
+	t.Run("should return an error for invalid args", func(t *testing.T) {
+		flags := flag.NewFlagSet("test", flag.ExitOnError)
+		flags.SetOutput(new(bytes.Buffer))
+		cfg := TestConfig{Runnable: func(r Runner) {}, Flags: flags}
+		err := cfg.Run(TestCase{Name: "invalid", Args: []string{"-unknown"}, SuppressLogs: true})
+		if err == nil || !strings.Contains(err.Error(), "failed to parse args") {
+			t.Errorf("expected a parse error. Got %v", err)
+		}
+		if flags.ErrorHandling() != flag.ExitOnError {
+			t.Errorf("expected the flag set's error handling to be restored. Got %v", flags.ErrorHandling())
+		}
+	})
+
+	t.Run("should return an error for args without flags", func(t *testing.T) {
+		cfg := TestConfig{Runnable: func(r Runner) {}}
+		err := cfg.Run(TestCase{Name: "no_flags", Args: []string{"-x"}, SuppressLogs: true})
+		if err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+
+	t.Run("should return an error if the test case has no name", func(t *testing.T) {
+		cfg := TestConfig{Runnable: func(r Runner) {}}
+		if err := cfg.Run(TestCase{Output: new(bytes.Buffer)}); err == nil {
+			t.Errorf("expected an error. got nil")
+		}
+	})
+
+	t.Run("should omit empty optional fields from the expectation", func(t *testing.T) {
+		var output bytes.Buffer
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo", "hello"}})
+		}}
+		if err := cfg.Run(TestCase{Name: "echo", Output: &output}); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if strings.Contains(output.String(), `"outputs"`) {
+			t.Errorf("expected no outputs key in expectation:\n%s", output.String())
+		}
+	})
+
+	t.Run("should write step logs to the log writer", func(t *testing.T) {
+		var logs MemoryLogWriter
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("build", Step{Command: []string{"make"}, Outputs: []string{"//CWD/out"}})
+			r.Run("test", Step{Command: []string{"make", "test"}})
+		}}
+		err := cfg.Run(TestCase{Name: "make", Output: new(bytes.Buffer), LogWriter: &logs})
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		expected := []StepLog{
+			{StepName: "build", Step: Step{Command: []string{"make"}, Outputs: []string{"[START_DIR]/out"}}},
+			{StepName: "test", Step: Step{Command: []string{"make", "test"}}},
+		}
+		if !reflect.DeepEqual(expected, logs.Entries) {
+			t.Errorf("expected step logs %+v. Got %+v", expected, logs.Entries)
+		}
+	})
+
+	t.Run("should not write the expectation if logs are suppressed", func(t *testing.T) {
+		var output bytes.Buffer
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo", "hello"}})
+		}}
+		if err := cfg.Run(TestCase{Name: "echo", Output: &output, SuppressLogs: true}); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		if output.Len() > 0 {
+			t.Errorf("expected no output. Got:\n%s", output.String())
+		}
+	})
+}
+
+func TestCreateExpectationFile(t *testing.T) {
+	skipCI(t)
+
+	t.Run("should create the file under the expectations dir", func(t *testing.T) {
+		file, err := CreateExpectationFile(t)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		file.Close()
+		defer os.RemoveAll("expectations")
+
+		cwd, _ := os.Getwd()
+		expected := filepath.Join(cwd, "expectations",
+			"TestCreateExpectationFile.should_create_the_file_under_the_expectations_dir.expected.json")
+		if file.Name() != expected {
+			t.Errorf("expected %s. Got %s", expected, file.Name())
+		}
+		if _, err := os.Stat(expected); err != nil {
+			t.Errorf("expected %s to exist: %v", expected, err)
+		}
+	})
+	t.Run("should create the expectations dir with a valid mode", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("File modes are not supported on Windows")
+		}
+		os.RemoveAll("expectations")
+		file, err := CreateExpectationFile(t)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		file.Close()
+		defer os.RemoveAll("expectations")
+
+		info, err := os.Stat("expectations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&0700 != 0700 || perm&^expectationDirMode != 0 {
+			t.Errorf("expected a mode within %v, accessible by its owner. Got %v",
+				expectationDirMode, perm)
+		}
+		if info.Mode()&(os.ModeSetgid|os.ModeAppend) != 0 {
+			t.Errorf("expected no special mode bits. Got %v", info.Mode())
+		}
+	})
+}
+
+func TestTestConfig_Expectations(t *testing.T) {
+	skipCI(t)
+	defer os.RemoveAll("expectations")
+
+	echo := func(message string) Runnable {
+		return func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo", message}})
+		}
+	}
+	tc := TestCase{Name: "TestTestConfig_Expectations"}
+	run := func(r Runnable) error {
+		cfg := TestConfig{Runnable: r}
+		return cfg.Run(tc)
+	}
+
+	t.Run("should write a missing expectation", func(t *testing.T) {
+		os.RemoveAll("expectations")
+		if err := run(echo("hello")); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join("expectations", expectationBasename(tc.Name, "", FormatJSON))); err != nil {
+			t.Errorf("expected the expectation to be written: %v", err)
+		}
+	})
+
+	t.Run("should pass if the expectation matches", func(t *testing.T) {
+		if err := run(echo("hello")); err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should fail if the expectation differs", func(t *testing.T) {
+		err := run(echo("goodbye"))
+		if err == nil || !strings.Contains(err.Error(), "goodbye") {
+			t.Errorf("expected an error describing the difference. Got %v", err)
+		}
+
+		// The expectation should be unchanged.
+		if err := run(echo("hello")); err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should update the expectation if requested", func(t *testing.T) {
+		if err := flag.Set("chow.update", "true"); err != nil {
+			t.Fatalf("expected the -chow.update flag in a test binary. Got %v", err)
+		}
+		defer flag.Set("chow.update", "false")
+
+		if err := run(echo("goodbye")); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		flag.Set("chow.update", "false")
+		if err := run(echo("goodbye")); err != nil {
+			t.Errorf("expected the updated expectation to match. Got %v", err)
+		}
+	})
+
+	t.Run("should update the expectation if CHOW_UPDATE is set", func(t *testing.T) {
+		os.Setenv(updateEnvVar, "1")
+		defer os.Unsetenv(updateEnvVar)
+
+		if err := run(echo("hello")); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		os.Unsetenv(updateEnvVar)
+		if err := run(echo("hello")); err != nil {
+			t.Errorf("expected the updated expectation to match. Got %v", err)
+		}
+	})
 }
 
-func TestTestRunner_Run(t *testing.T) {
-	// Expects that executing the given steps w/ the given mocks produces the given step
-	// log.  Results in a test failure if the actual log differs.
-	expectOutput := func(t *testing.T, step []Step, mocks []Mock, expected []stepLog) {
-		// Execute the program.
-		runner := &testRunner{Mocks: mocks}
-		for i := range step {
-			runner.Run("step_"+fmt.Sprint(i), step[i])
+func TestTestConfig_ExpectationDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("should write expectations to the given directory", func(t *testing.T) {
+		outDir := filepath.Join(dir, "golden")
+		cfg := TestConfig{Runnable: func(r Runner) {}, ExpectationDir: outDir}
+		if err := cfg.Run(TestCase{Name: "custom"}); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
 		}
 
-		// Verify the results.
-		actual := runner.stepLogs
-		if len(expected) != len(actual) {
-			t.Fatalf("expected %v Got %v", expected, actual)
+		if _, err := os.Stat(filepath.Join(outDir, "custom.expected.json")); err != nil {
+			t.Errorf("expected the expectation to be written: %v", err)
+		}
+		if runtime.GOOS == "windows" {
+			return
+		}
+		info, err := os.Stat(outDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&0700 != 0700 {
+			t.Errorf("expected the directory to be accessible by its owner. Got %v", perm)
 		}
+	})
+}
 
-		for i := 0; i < len(expected); i++ {
-			expectLogsEqual(t, expected[i], actual[i])
+func TestPlatformExpectations(t *testing.T) {
+	runnable := func(r Runner) {
+		if r.Platform() == "windows" {
+			r.Run("list", Step{Command: []string{"cmd", "/c", "dir"}})
+		} else {
+			r.Run("list", Step{Command: []string{"ls"}})
 		}
 	}
 
-	t.Run("step output should be mocked", func(t *testing.T) {
-		t.Run("when a mock step name matches", func(t *testing.T) {
-			step := Step{Command: []string{"command"}}
-			inputs := []Step{step, step, step}
+	t.Run("should generate platform-specific expectations", func(t *testing.T) {
+		for _, platform := range []string{"linux", "windows"} {
+			var output bytes.Buffer
+			cfg := TestConfig{Runnable: runnable}
+			if err := cfg.Run(TestCase{Name: "list", Platform: platform, Output: &output}); err != nil {
+				t.Fatalf("expected no error. Got %v", err)
+			}
 
-			mocks := []Mock{{
-				Step: "step_1",
-				Result: StepResult{
-					Stdout:   "mocked stdout",
-					Stderr:   "mocked stderr",
-					ExitCode: 31,
-				},
-			}}
+			var logs []StepLog
+			if err := json.Unmarshal(output.Bytes(), &logs); err != nil {
+				t.Fatal(err)
+			}
+			isWindows := logs[0].Step.Command[0] == "cmd"
+			if isWindows != (platform == "windows") {
+				t.Errorf("expected a %s command. Got %v", platform, logs[0].Step.Command)
+			}
+		}
 
-			result := []stepLog{{
-				StepName:   "step_0",
-				Step:       step,
-				StepResult: StepResult{},
-			}, {
-				StepName: "step_1",
-				Step:     step,
-				StepResult: StepResult{
-					Stdout:   "mocked stdout",
-					Stderr:   "mocked stderr",
-					ExitCode: 31,
-				},
-			}, {
-				StepName:   "step_2",
-				Step:       step,
-				StepResult: StepResult{},
-			}}
+		if expected, actual := "a.b.windows.expected.json", expectationBasename("a/b", "windows", FormatJSON); expected != actual {
+			t.Errorf("expected basename %s. Got %s", expected, actual)
+		}
+		if expected, actual := "a.b.expected.json", expectationBasename("a/b", "", FormatJSON); expected != actual {
+			t.Errorf("expected basename %s. Got %s", expected, actual)
+		}
+	})
 
-			expectOutput(t, inputs, mocks, result)
-		})
+	t.Run("should generate filesystem-safe basenames", func(t *testing.T) {
+		expected := "build_linux.amd64_release.expected.json"
+		if actual := expectationBasename(`build: linux//amd64  "release"?`, "", FormatJSON); expected != actual {
+			t.Errorf("expected basename %s. Got %s", expected, actual)
+		}
 	})
 
-	t.Run("step output should be empty", func(t *testing.T) {
-		t.Run("when there are no mocks", func(t *testing.T) {
-			inputs := []Step{{
-				Command: []string{"command", "arg1", "arg2"},
-				Outputs: []string{"output"},
-			}}
+	t.Run("should prefer a platform-specific expectation", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "expectations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
 
-			result := []stepLog{{
-				StepName: "step_0",
-				Step:     inputs[0],
-			}}
+		shared := filepath.Join(dir, "list.expected.json")
+		windows := filepath.Join(dir, "list.windows.expected.json")
+		ioutil.WriteFile(shared, nil, 0644)
+		ioutil.WriteFile(windows, nil, 0644)
 
-			expectOutput(t, inputs, []Mock{}, result)
+		if path, ok := findExpectation(dir, "list", "windows", FormatJSON); !ok || path != windows {
+			t.Errorf("expected %s. Got %s", windows, path)
+		}
+		if path, ok := findExpectation(dir, "list", "linux", FormatJSON); !ok || path != shared {
+			t.Errorf("expected %s. Got %s", shared, path)
+		}
+		if _, ok := findExpectation(dir, "missing", "linux", FormatJSON); ok {
+			t.Errorf("expected no expectation for a missing test case")
+		}
+	})
+
+	t.Run("should compare against the shared expectation if there is no platform one", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "expectations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		shared := filepath.Join(dir, "list.expected.yaml")
+		expected := []StepLog{{StepName: "list", Step: Step{Command: []string{"ls"}}}}
+		if err := writeExpectationFile(shared, expected, FormatYAML); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := TestConfig{Runnable: runnable, ExpectationDir: dir}
+		tc := TestCase{Name: "list", Platform: "linux", Format: FormatYAML}
+		if err := cfg.Run(tc); err != nil {
+			t.Errorf("expected the shared expectation to match. Got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "list.linux.expected.yaml")); !os.IsNotExist(err) {
+			t.Errorf("expected no platform-specific expectation to be written. Got %v", err)
+		}
+
+		tc.Platform = "windows"
+		if err := cfg.Run(tc); err == nil {
+			t.Errorf("expected a mismatch against the shared expectation")
+		}
+
+		os.Setenv(updateEnvVar, "1")
+		defer os.Unsetenv(updateEnvVar)
+		if err := cfg.Run(tc); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "list.windows.expected.yaml")); err != nil {
+			t.Errorf("expected the update to write a platform-specific expectation. Got %v", err)
+		}
+		os.Unsetenv(updateEnvVar)
+		tc.Platform = "linux"
+		if err := cfg.Run(tc); err != nil {
+			t.Errorf("expected the shared expectation to be unchanged. Got %v", err)
+		}
+	})
+}
+
+func TestWhitespacePolicy(t *testing.T) {
+	expected := []StepLog{{
+		StepName:   "step",
+		StepResult: StepResult{Stdout: "output", Stderr: "error", Combined: "output\nerror"},
+	}}
+	actual := []StepLog{{
+		StepName:   "step",
+		StepResult: StepResult{Stdout: "output\n", Stderr: "error\n", Combined: "output\nerror\n"},
+	}}
+
+	t.Run("should ignore a trailing newline when trimming", func(t *testing.T) {
+		if !TrimTrailingWhitespace.equal(expected, actual) {
+			t.Errorf("expected %v to equal %v", expected, actual)
+		}
+	})
+
+	t.Run("should not ignore a trailing newline when preserving", func(t *testing.T) {
+		if PreserveTrailingWhitespace.equal(expected, actual) {
+			t.Errorf("expected %v to differ from %v", expected, actual)
+		}
+	})
+
+	t.Run("should trim by default", func(t *testing.T) {
+		if (TestConfig{}).Whitespace != TrimTrailingWhitespace {
+			t.Errorf("expected the default policy to trim trailing whitespace")
+		}
+	})
+}
+
+func TestWhitespacePolicy_Compare(t *testing.T) {
+	golden := `[{
+		"step_name": "generate",
+		"step": {"command": ["gen"]},
+		"result": {"exit_code": 0, "outputs": {"[START_DIR]/config.json": "{\"debug\": false}"}}
+	}]`
+	var expected []StepLog
+	if err := json.Unmarshal([]byte(golden), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// Runs the application with the given mocked outputs.
+	run := func(outputs map[string]string) []StepLog {
+		return runTest(func(r Runner) {
+			r.Run("generate", Step{Command: []string{"gen"}})
+		}, TestCase{Mocks: []Mock{{
+			Step:   "generate",
+			Result: StepResult{Outputs: outputs},
+		}}}).stepLogs
+	}
+
+	t.Run("should pass if the outputs match", func(t *testing.T) {
+		actual := run(map[string]string{"//CWD/config.json": `{"debug": false}`})
+		if err := TrimTrailingWhitespace.compare(expected, actual); err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should fail if an output changed", func(t *testing.T) {
+		actual := run(map[string]string{"//CWD/config.json": `{"debug": true}`})
+		err := TrimTrailingWhitespace.compare(expected, actual)
+		if err == nil || !strings.Contains(err.Error(), `output "[START_DIR]/config.json"`) {
+			t.Errorf("expected an error naming the changed output. Got %v", err)
+		}
+	})
+
+	t.Run("should fail if an output is missing", func(t *testing.T) {
+		err := TrimTrailingWhitespace.compare(expected, run(nil))
+		if err == nil || !strings.Contains(err.Error(), "missing output") {
+			t.Errorf("expected an error naming the missing output. Got %v", err)
+		}
+	})
+}
+
+func TestExpectationFormat(t *testing.T) {
+	logs := []StepLog{{
+		StepName: "build",
+		Step: Step{
+			Command: []string{"make"},
+			Env:     map[string]string{"CC": "clang"},
+			Timeout: time.Minute,
+		},
+		StepResult:  StepResult{Stdout: "ok", ExitCode: 1, Outputs: map[string]string{"out": "a"}},
+		OutputModes: map[string]os.FileMode{"out": 0755},
+	}}
+
+	for _, format := range []ExpectationFormat{FormatJSON, FormatYAML} {
+		t.Run(fmt.Sprintf("should round-trip step logs in format %d", format), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := format.encode(&b, logs); err != nil {
+				t.Fatalf("expected no error. Got %v", err)
+			}
+			actual, err := format.decode(b.Bytes())
+			if err != nil {
+				t.Fatalf("expected no error. Got %v", err)
+			}
+			if !reflect.DeepEqual(logs, actual) {
+				t.Errorf("expected %+v. Got %+v", logs, actual)
+			}
 		})
-		t.Run("when a mock step name does not match", func(t *testing.T) {
-			inputs := []Step{{
-				Command: []string{"command", "arg1", "arg2"},
-				Outputs: []string{"output"},
-			}}
+	}
 
-			result := []stepLog{{
-				StepName: "step_0",
-				Step:     inputs[0],
-			}}
+	t.Run("should write YAML expectations", func(t *testing.T) {
+		var output bytes.Buffer
+		cfg := TestConfig{Runnable: func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo", "hello"}})
+		}}
+		if err := cfg.Run(TestCase{Name: "echo", Output: &output, Format: FormatYAML}); err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		if !strings.Contains(output.String(), "step_name: echo") {
+			t.Errorf("expected a YAML expectation. Got:\n%s", output.String())
+		}
+	})
+}
 
-			expectOutput(t, inputs, []Mock{}, result)
+func TestValidateExpectation(t *testing.T) {
+	t.Run("should accept a valid expectation", func(t *testing.T) {
+		var b bytes.Buffer
+		logs := []StepLog{{StepName: "build", Step: Step{Command: []string{"make"}}}}
+		if err := encodeExpectation(&b, logs); err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateExpectation(&b); err != nil {
+			t.Errorf("expected no error. Got %v", err)
+		}
+	})
+
+	t.Run("should reject an unknown field", func(t *testing.T) {
+		err := ValidateExpectation(strings.NewReader(`[
+  {
+    "step_name": "build",
+    "stepp": {}
+  }
+]`))
+		if err == nil || !strings.Contains(err.Error(), "line 4") || !strings.Contains(err.Error(), "stepp") {
+			t.Errorf("expected an error naming the field and its line. Got %v", err)
+		}
+	})
+
+	t.Run("should reject a malformed expectation", func(t *testing.T) {
+		err := ValidateExpectation(strings.NewReader(`[
+  {
+    "step_name": "build",
+  }
+]`))
+		if err == nil || !strings.Contains(err.Error(), "line 4") {
+			t.Errorf("expected an error naming the line. Got %v", err)
+		}
+	})
+}
+
+func TestDiffStepLogs(t *testing.T) {
+	expected := []StepLog{{
+		StepName: "build",
+		Step:     Step{Command: []string{"make", "all"}},
+	}}
+
+	t.Run("should describe a changed command", func(t *testing.T) {
+		actual := []StepLog{{
+			StepName: "build",
+			Step:     Step{Command: []string{"make", "test"}},
+		}}
+
+		want := []string{`step "build": -command: []string{"make", "all"} -> []string{"make", "test"}`}
+		if diffs := DiffStepLogs(expected, actual); !reflect.DeepEqual(want, diffs) {
+			t.Errorf("expected %q. Got %q", want, diffs)
+		}
+	})
+
+	t.Run("should describe a changed exit code", func(t *testing.T) {
+		actual := []StepLog{{
+			StepName:   "build",
+			Step:       Step{Command: []string{"make", "all"}},
+			StepResult: StepResult{ExitCode: 2},
+		}}
+
+		want := []string{`step "build": -exit code: 0 -> 2`}
+		if diffs := DiffStepLogs(expected, actual); !reflect.DeepEqual(want, diffs) {
+			t.Errorf("expected %q. Got %q", want, diffs)
+		}
+	})
+
+	t.Run("should describe a missing step", func(t *testing.T) {
+		want := []string{"-steps: 1 -> 0", `step "build": missing`}
+		if diffs := DiffStepLogs(expected, nil); !reflect.DeepEqual(want, diffs) {
+			t.Errorf("expected %q. Got %q", want, diffs)
+		}
+	})
+
+	t.Run("should return nothing for equal logs", func(t *testing.T) {
+		if diffs := DiffStepLogs(expected, expected); len(diffs) > 0 {
+			t.Errorf("expected no differences. Got %q", diffs)
+		}
+	})
+}
+
+func TestChowError(t *testing.T) {
+	t.Run("should return a ChowError from Main", func(t *testing.T) {
+		step := Step{Command: []string{"missing-binary"}}
+		err := runMain(func(r Runner) {
+			r.Run("missing", step)
+		}, nil, nil, MainOptions{Stdout: new(bytes.Buffer)})
+
+		chowErr, ok := err.(*ChowError)
+		if !ok {
+			t.Fatalf("expected a *ChowError. Got %T: %v", err, err)
+		}
+		if chowErr.Message != "failed to find binary" {
+			t.Errorf("expected the message %q. Got %q", "failed to find binary", chowErr.Message)
+		}
+		if !reflect.DeepEqual(step, chowErr.Step) {
+			t.Errorf("expected the failed step %v. Got %v", step, chowErr.Step)
+		}
+	})
+
+	t.Run("should unwrap to the original cause", func(t *testing.T) {
+		cause := errors.New("cause")
+		err := recoverFatal(func() {
+			logFatal("failed", cause, Step{})
 		})
+		chowErr, ok := err.(*ChowError)
+		if !ok {
+			t.Fatalf("expected a *ChowError. Got %T: %v", err, err)
+		}
+		if chowErr.Unwrap() != cause {
+			t.Errorf("expected to unwrap to the cause. Got %v", chowErr.Unwrap())
+		}
+		if !strings.Contains(err.Error(), "chow: FATAL: failed: cause") {
+			t.Errorf("expected a formatted message. Got %q", err.Error())
+		}
+	})
+
+	t.Run("should include the output of a failed step", func(t *testing.T) {
+		err := stepError("step failed", errors.New("exited with code 1"), Step{},
+			StepResult{Stdout: "some output"})
+		if !strings.Contains(err.Error(), "STDOUT:\nsome output") {
+			t.Errorf("expected the step's output. Got %q", err.Error())
+		}
+	})
+}
+
+func TestProdRunner_TryRun(t *testing.T) {
+	t.Run("should return an error if the binary is missing", func(t *testing.T) {
+		var tryErr error
+		ran := false
+		err := runRunnable(func(r Runner) {
+			_, tryErr = r.TryRun("missing", Step{Command: []string{"missing-binary"}})
+			ran = true
+		}, os.Stdout, os.Stderr, options{})
+
+		if err != nil {
+			t.Fatalf("expected the run to succeed. Got %v", err)
+		}
+		if !ran {
+			t.Errorf("expected the runnable to continue after the failed step")
+		}
+		if chowErr, ok := tryErr.(*ChowError); !ok || chowErr.Message != "failed to find binary" {
+			t.Errorf("expected a *ChowError for the missing binary. Got %v", tryErr)
+		}
+	})
+
+	t.Run("should return an error if the command is empty", func(t *testing.T) {
+		var tryErr error
+		err := runMain(func(r Runner) {
+			_, tryErr = r.TryRun("empty", Step{})
+			r.Run("empty", Step{})
+		}, nil, nil, MainOptions{Stdout: new(bytes.Buffer)})
+
+		if tryErr == nil {
+			t.Errorf("expected TryRun to return an error")
+		}
+		if err == nil || !strings.Contains(err.Error(), "empty command") {
+			t.Errorf("expected Run to fail the run. Got %v", err)
+		}
+	})
+
+	t.Run("should return an error if the step fails", func(t *testing.T) {
+		exitPath := buildTestBinary(t, "exit")
+		defer os.RemoveAll(exitPath)
+
+		var result StepResult
+		var tryErr error
+		err := runRunnable(func(r Runner) {
+			result, tryErr = r.TryRun("fail", Step{
+				Command:           []string{"./" + exitPath, "3"},
+				FailOnNonZeroExit: true,
+			})
+		}, os.Stdout, os.Stderr, options{})
+
+		if err != nil {
+			t.Fatalf("expected the run to succeed. Got %v", err)
+		}
+		if tryErr == nil {
+			t.Errorf("expected an error")
+		}
+		if result.ExitCode != 3 {
+			t.Errorf("expected exit code 3. Got %d", result.ExitCode)
+		}
+	})
+}
+
+func TestRunRunnable_Panic(t *testing.T) {
+	t.Run("should propagate panics that are not framework errors", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("expected the panic to propagate. Got %v", r)
+			}
+		}()
+		runRunnable(func(r Runner) {
+			panic("boom")
+		}, os.Stdout, os.Stderr, options{})
+	})
+}
+
+func TestProdRunner_Cancel(t *testing.T) {
+	echoPath := buildTestBinary(t, "echo")
+	sleepPath := buildTestBinary(t, "sleep")
+	defer func() {
+		os.RemoveAll(echoPath)
+		os.RemoveAll(sleepPath)
+	}()
+
+	t.Run("should skip steps after the run is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var results []StepResult
+		stdout := new(bytes.Buffer)
+		err := runRunnable(func(r Runner) {
+			results = append(results, r.Run("before", Step{Command: []string{"./" + echoPath, "a"}}))
+			cancel()
+			results = append(results, r.Run("after", Step{Command: []string{"./" + echoPath, "b"}}))
+		}, stdout, os.Stderr, options{ctx: ctx})
+
+		if err == nil {
+			t.Errorf("expected the cancelled run to fail")
+		}
+		if len(results) != 2 || results[0].ExitCode != 0 || results[1].ExitCode != CancelledExitCode {
+			t.Errorf("expected the second step to be cancelled. Got %v", results)
+		}
+		if strings.Contains(stdout.String(), `"after"`) {
+			t.Errorf("expected only the first step to be logged. Got %s", stdout)
+		}
 	})
+
+	t.Run("should kill a running step when the run is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		var result StepResult
+		start := time.Now()
+		err := runRunnable(func(r Runner) {
+			result = r.Run("sleep", Step{Command: []string{"./" + sleepPath, "10s"}})
+		}, os.Stdout, os.Stderr, options{ctx: ctx})
+
+		if err == nil {
+			t.Errorf("expected the cancelled run to fail")
+		}
+		if result.ExitCode != CancelledExitCode {
+			t.Errorf("expected exit code %d. Got %d", CancelledExitCode, result.ExitCode)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected the step to be killed. It ran for %v", elapsed)
+		}
+	})
+
+	t.Run("should report a step as cancelled when the run's deadline expires", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		var result StepResult
+		err := runRunnable(func(r Runner) {
+			result = r.Run("sleep", Step{
+				Command: []string{"./" + sleepPath, "10s"},
+				Timeout: time.Minute,
+			})
+		}, os.Stdout, os.Stderr, options{ctx: ctx})
+
+		if err == nil || strings.Contains(err.Error(), "timed out") {
+			t.Errorf("expected the run to be cancelled. Got %v", err)
+		}
+		if result.ExitCode != CancelledExitCode {
+			t.Errorf("expected exit code %d. Got %d", CancelledExitCode, result.ExitCode)
+		}
+	})
+
+	t.Run("should cancel the run when MainOptions.Context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var result StepResult
+		runResult := Run(func(r Runner) {
+			result = r.Run("echo", Step{Command: []string{"./" + echoPath, "a"}})
+		}, nil, MainOptions{Args: []string{}, Stdout: new(bytes.Buffer), Context: ctx})
+
+		if runResult.Err == nil {
+			t.Errorf("expected the cancelled run to fail")
+		}
+		if result.ExitCode != CancelledExitCode {
+			t.Errorf("expected exit code %d. Got %d", CancelledExitCode, result.ExitCode)
+		}
+	})
+}
+
+func TestExitCodeOf(t *testing.T) {
+	t.Run("should return an error that is not an exit error", func(t *testing.T) {
+		if _, err := exitCodeOf(io.ErrUnexpectedEOF); err != io.ErrUnexpectedEOF {
+			t.Errorf("expected %v. Got %v", io.ErrUnexpectedEOF, err)
+		}
+	})
+}
+
+// An io.Writer that always fails, like a closed pipe.
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Runs fn and returns the error from any fatal error it raises.
+func recoverFatal(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	fn()
+	return nil
 }
 
 func buildTestBinary(t *testing.T, tool string) string {
@@ -282,7 +4090,7 @@ func buildTestBinary(t *testing.T, tool string) string {
 	return path
 }
 
-func expectLogsEqual(t *testing.T, expected, actual stepLog) {
+func expectLogsEqual(t *testing.T, expected, actual StepLog) {
 	if !stepLogsEqual(expected, actual) {
 		b := new(bytes.Buffer)
 		diffs := pretty.Diff(expected, actual)
@@ -298,19 +4106,21 @@ func expectLogsEqual(t *testing.T, expected, actual stepLog) {
 	}
 }
 
-func stepLogsEqual(a, b stepLog) bool {
+func stepLogsEqual(a, b StepLog) bool {
 	return a.StepName == b.StepName &&
 		reflect.DeepEqual(a.Step, b.Step) &&
 		strings.TrimSpace(a.StepResult.Stdout) == strings.TrimSpace(b.StepResult.Stdout) &&
 		strings.TrimSpace(a.StepResult.Stderr) == strings.TrimSpace(b.StepResult.Stderr) &&
+		strings.TrimSpace(a.StepResult.Combined) == strings.TrimSpace(b.StepResult.Combined) &&
+		reflect.DeepEqual(a.StepResult.Outputs, b.StepResult.Outputs) &&
 		a.StepResult.ExitCode == b.StepResult.ExitCode
 }
 
 type MemoryLogWriter struct {
-	Entries []stepLog
+	Entries []StepLog
 }
 
-func (w *MemoryLogWriter) Write(s stepLog) error {
+func (w *MemoryLogWriter) Write(s StepLog) error {
 	w.Entries = append(w.Entries, s)
 	return nil
 }
@@ -0,0 +1,138 @@
+package chow
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// References to input fields in a command template, e.g. "{.Username}".
+var inputRef = regexp.MustCompile(`\{\.([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)\}`)
+
+// BuildCommand returns the command described by template, with references to the fields
+// of inputs expanded.
+//
+// This allows a step's command to be derived from a struct of typed inputs, without
+// running arbitrary logic to build it.  For example:
+//
+//     type Inputs struct {
+//         Username string
+//     }
+//
+//     command, err := BuildCommand(`echo "Hello, {.Username}"`, Inputs{Username: "Kendal"})
+//
+// template is split into arguments at unquoted whitespace, like a shell would.  Single
+// or double quotes group words into a single argument, and are removed.  A reference
+// "{.Field}" is replaced by the value of the exported field of inputs, which must be a
+// struct or a pointer to one, formatted as if by fmt.Sprint.  Nested fields may be
+// referenced like "{.Field.Nested}".  Since references are expanded after the template
+// is split, a value containing whitespace is never split into several arguments.
+//
+// An error is returned if a quote is not closed, or a reference names a field that does
+// not exist.
+func BuildCommand(template string, inputs interface{}) ([]string, error) {
+	args, err := splitCommand(template)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, arg := range args {
+		var refErr error
+		args[i] = inputRef.ReplaceAllStringFunc(arg, func(ref string) string {
+			name := inputRef.FindStringSubmatch(ref)[1]
+			value, err := inputField(inputs, name)
+			if err != nil && refErr == nil {
+				refErr = err
+			}
+			return value
+		})
+		if refErr != nil {
+			return nil, refErr
+		}
+	}
+	return args, nil
+}
+
+// Splits command into arguments at unquoted whitespace, removing quotes.
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, c := range command {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c in command %q", quote, command)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("command is empty")
+	}
+	return args, nil
+}
+
+// Joins args into a command line that splitCommand splits back into args, quoting any
+// argument that is empty or contains whitespace or quotes.  An argument that contains
+// both kinds of quote cannot be represented, and is double-quoted.
+func joinCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case arg != "" && !strings.ContainsAny(arg, "\"' \t\n\r\v\f"):
+			quoted[i] = arg
+		case strings.Contains(arg, "'"):
+			quoted[i] = `"` + arg + `"`
+		default:
+			quoted[i] = "'" + arg + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Returns the formatted value of the field of inputs with the given dotted name.
+func inputField(inputs interface{}, name string) (string, error) {
+	value := reflect.ValueOf(inputs)
+	for _, field := range strings.Split(name, ".") {
+		for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+			if value.IsNil() {
+				return "", fmt.Errorf("cannot read input field %q of nil value", name)
+			}
+			value = value.Elem()
+		}
+		if value.Kind() != reflect.Struct {
+			return "", fmt.Errorf("cannot read input field %q of non-struct value", name)
+		}
+
+		structField, ok := value.Type().FieldByName(field)
+		if !ok || structField.PkgPath != "" {
+			return "", fmt.Errorf("unknown input field %q", name)
+		}
+		value = value.FieldByIndex(structField.Index)
+	}
+	return fmt.Sprint(value.Interface()), nil
+}
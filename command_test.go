@@ -0,0 +1,81 @@
+package chow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildCommand(t *testing.T) {
+	type Repo struct {
+		URL string
+	}
+	type Inputs struct {
+		Username string
+		Count    int
+		Repo     *Repo
+	}
+	inputs := Inputs{Username: "Kendal Harland", Count: 3, Repo: &Repo{URL: "https://example.com"}}
+
+	t.Run("should expand a field", func(t *testing.T) {
+		command, err := BuildCommand("echo {.Username} {.Count}", inputs)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		expected := []string{"echo", "Kendal Harland", "3"}
+		if !reflect.DeepEqual(expected, command) {
+			t.Errorf("expected %q. Got %q", expected, command)
+		}
+	})
+
+	t.Run("should expand a nested field", func(t *testing.T) {
+		command, err := BuildCommand("git clone {.Repo.URL}", &inputs)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		expected := []string{"git", "clone", "https://example.com"}
+		if !reflect.DeepEqual(expected, command) {
+			t.Errorf("expected %q. Got %q", expected, command)
+		}
+	})
+
+	t.Run("should preserve quoted arguments", func(t *testing.T) {
+		command, err := BuildCommand(`echo "Hello, {.Username}" '' 'a  b'`, inputs)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		expected := []string{"echo", "Hello, Kendal Harland", "", "a  b"}
+		if !reflect.DeepEqual(expected, command) {
+			t.Errorf("expected %q. Got %q", expected, command)
+		}
+	})
+
+	t.Run("should error for a missing field", func(t *testing.T) {
+		_, err := BuildCommand("echo {.Password}", inputs)
+		if err == nil || !strings.Contains(err.Error(), "Password") {
+			t.Errorf("expected an error naming the field. Got %v", err)
+		}
+	})
+
+	t.Run("should error for an unterminated quote", func(t *testing.T) {
+		if _, err := BuildCommand(`echo "hello`, inputs); err == nil {
+			t.Errorf("expected an error. Got nil")
+		}
+	})
+}
+
+func TestJoinCommand(t *testing.T) {
+	args := []string{"echo", "", "a b", `it's`, `say "hi"`, "/path/to/file"}
+	command := joinCommand(args)
+
+	expected := `echo '' 'a b' "it's" 'say "hi"' /path/to/file`
+	if command != expected {
+		t.Errorf("expected %s. Got %s", expected, command)
+	}
+	if split, err := splitCommand(command); err != nil || !reflect.DeepEqual(args, split) {
+		t.Errorf("expected the command to split into %q. Got %q, %v", args, split, err)
+	}
+}
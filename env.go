@@ -0,0 +1,89 @@
+package chow
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SecretEnv lists the names of environment variables whose values are redacted from
+// recorded environments.  Names may be patterns, as understood by path.Match.
+var SecretEnv = []string{"*TOKEN*", "*SECRET*", "*PASSWORD*", "*_KEY"}
+
+// The value recorded in place of a secret environment variable.
+const redacted = "[REDACTED]"
+
+// Returns the environment a step's child process receives: the current process's
+// environment, overridden by the step's own variables.
+func stepEnv(step Step) []string {
+	return mergeEnv(os.Environ(), step.Env)
+}
+
+// Returns env, a list of "key=value" strings, overridden by vars.  The variables in vars
+// are appended in sorted order.
+func mergeEnv(env []string, vars map[string]string) []string {
+	var merged []string
+	for _, entry := range env {
+		key := strings.SplitN(entry, "=", 2)[0]
+		if _, ok := vars[key]; !ok {
+			merged = append(merged, entry)
+		}
+	}
+
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		merged = append(merged, key+"="+vars[key])
+	}
+	return merged
+}
+
+// Returns a copy of args with references to the variables in env, a list of
+// "key=value" strings, expanded as by os.Expand.  Later entries in env take precedence.
+func expandEnv(args []string, env []string) []string {
+	values := make(map[string]string, len(env))
+	for _, entry := range env {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = os.Expand(arg, func(key string) string { return values[key] })
+	}
+	return expanded
+}
+
+// Converts env, a list of "key=value" strings, to a map, redacting the values of any
+// variables listed in SecretEnv.
+func redactEnv(env []string) map[string]string {
+	redactedEnv := make(map[string]string, len(env))
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key, value := parts[0], parts[1]
+		if isSecretEnv(key) {
+			value = redacted
+		}
+		redactedEnv[key] = value
+	}
+	return redactedEnv
+}
+
+// Reports whether the environment variable with the given name is a secret.
+func isSecretEnv(key string) bool {
+	for _, pattern := range SecretEnv {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
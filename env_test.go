@@ -0,0 +1,204 @@
+package chow
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStepEnv(t *testing.T) {
+	os.Setenv("CHOW_TEST_VALUE", "inherited")
+	defer os.Unsetenv("CHOW_TEST_VALUE")
+
+	t.Run("should let step variables override inherited ones", func(t *testing.T) {
+		env := redactEnv(stepEnv(Step{Env: map[string]string{
+			"CHOW_TEST_VALUE": "overridden",
+			"CHOW_TEST_OTHER": "added",
+		}}))
+
+		if env["CHOW_TEST_VALUE"] != "overridden" {
+			t.Errorf("expected CHOW_TEST_VALUE=overridden. Got %q", env["CHOW_TEST_VALUE"])
+		}
+		if env["CHOW_TEST_OTHER"] != "added" {
+			t.Errorf("expected CHOW_TEST_OTHER=added. Got %q", env["CHOW_TEST_OTHER"])
+		}
+	})
+
+	t.Run("should inherit the environment given an empty map", func(t *testing.T) {
+		env := stepEnv(Step{Env: map[string]string{}})
+		if !reflect.DeepEqual(env, os.Environ()) {
+			t.Errorf("expected the inherited environment. Got %v", env)
+		}
+	})
+
+	t.Run("should convert paths in values", func(t *testing.T) {
+		echoPath := buildTestBinary(t, "echo")
+		defer os.RemoveAll(echoPath)
+
+		startDir, _ := os.Getwd()
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			startDir:   startDir,
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+			recordEnv:  true,
+		}
+		env := map[string]string{"CHOW_TEST_OUT": "//out"}
+		runner.Run("echo", Step{Command: []string{"./" + echoPath}, Env: env})
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+
+		expected := filepath.FromSlash(startDir + "/out")
+		if log.Step.Env["CHOW_TEST_OUT"] != expected {
+			t.Errorf("expected step env %s. Got %q", expected, log.Step.Env["CHOW_TEST_OUT"])
+		}
+		if log.Env["CHOW_TEST_OUT"] != expected {
+			t.Errorf("expected recorded env %s. Got %q", expected, log.Env["CHOW_TEST_OUT"])
+		}
+		if env["CHOW_TEST_OUT"] != "//out" {
+			t.Errorf("expected the caller's env to be unmodified. Got %v", env)
+		}
+	})
+}
+
+func TestRecordEnv(t *testing.T) {
+	os.Setenv("CHOW_TEST_VALUE", "value")
+	os.Setenv("CHOW_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("CHOW_TEST_VALUE")
+	defer os.Unsetenv("CHOW_TEST_TOKEN")
+
+	echoPath := buildTestBinary(t, "echo")
+	defer os.RemoveAll(echoPath)
+
+	expectEnv := func(t *testing.T, env map[string]string) {
+		if env["CHOW_TEST_VALUE"] != "value" {
+			t.Errorf("expected CHOW_TEST_VALUE=value. Got %q", env["CHOW_TEST_VALUE"])
+		}
+		if env["CHOW_TEST_TOKEN"] != redacted {
+			t.Errorf("expected CHOW_TEST_TOKEN to be redacted. Got %q", env["CHOW_TEST_TOKEN"])
+		}
+	}
+
+	t.Run("should record the redacted environment in production", func(t *testing.T) {
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+			recordEnv:  true,
+		}
+		runner.Run("echo", Step{Command: []string{"./" + echoPath}})
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		expectEnv(t, log.Env)
+	})
+
+	t.Run("should omit the environment in production by default", func(t *testing.T) {
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: &stepOutput,
+		}
+		runner.Run("echo", Step{Command: []string{"./" + echoPath}})
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step log: %v", err)
+		}
+		if log.Env != nil {
+			t.Errorf("expected no environment. Got %v", log.Env)
+		}
+	})
+
+	t.Run("should omit the environment in tests by default", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo"}})
+		}, TestCase{})
+
+		if runner.stepLogs[0].Env != nil {
+			t.Errorf("expected no environment. Got %v", runner.stepLogs[0].Env)
+		}
+	})
+
+	t.Run("should record the stubbed environment in tests when requested", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo"}, Env: map[string]string{"CHOW_TEST_STEP": "step"}})
+		}, TestCase{RecordEnv: true, Env: map[string]string{
+			"CHOW_TEST_VALUE": "value",
+			"CHOW_TEST_TOKEN": "s3cret",
+		}})
+
+		expected := map[string]string{
+			"CHOW_TEST_VALUE": "value",
+			"CHOW_TEST_TOKEN": redacted,
+			"CHOW_TEST_STEP":  "step",
+		}
+		if env := runner.stepLogs[0].Env; !reflect.DeepEqual(expected, env) {
+			t.Errorf("expected only the stubbed environment %v. Got %v", expected, env)
+		}
+	})
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Run("should expand variables in production", func(t *testing.T) {
+		os.Setenv("CHOW_TEST_GREETING", "Hello")
+		defer os.Unsetenv("CHOW_TEST_GREETING")
+
+		echoPath := buildTestBinary(t, "echo")
+		defer os.RemoveAll(echoPath)
+
+		startDir, _ := os.Getwd()
+		runner := &prodRunner{
+			startDir:   startDir,
+			stdout:     new(bytes.Buffer),
+			stderr:     os.Stderr,
+			stepOutput: new(bytes.Buffer),
+		}
+		result := runner.Run("echo", Step{
+			Command:   []string{"./" + echoPath, "$CHOW_TEST_GREETING, ${CHOW_TEST_NAME}!"},
+			Env:       map[string]string{"CHOW_TEST_NAME": "chow"},
+			ExpandEnv: true,
+		})
+
+		if result.Stdout != "Hello, chow!" {
+			t.Errorf("expected expanded stdout. Got %q", result.Stdout)
+		}
+	})
+
+	t.Run("should expand variables against the stubbed environment in tests", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("echo", Step{
+				Command:   []string{"echo", "$GREETING", "${NAME}", "[$UNDEFINED]", "$OUT/file"},
+				Env:       map[string]string{"NAME": "step"},
+				ExpandEnv: true,
+			})
+		}, TestCase{Env: map[string]string{"GREETING": "Hello", "NAME": "process", "OUT": "//out"}})
+
+		expected := []string{"echo", "Hello", "step", "[]", "[START_DIR]/out/file"}
+		if command := runner.stepLogs[0].Step.Command; !reflect.DeepEqual(expected, command) {
+			t.Errorf("expected command %q. Got %q", expected, command)
+		}
+	})
+
+	t.Run("should not expand variables unless requested", func(t *testing.T) {
+		runner := runTest(func(r Runner) {
+			r.Run("echo", Step{Command: []string{"echo", "$GREETING"}})
+		}, TestCase{Env: map[string]string{"GREETING": "Hello"}})
+
+		expected := []string{"echo", "$GREETING"}
+		if command := runner.stepLogs[0].Step.Command; !reflect.DeepEqual(expected, command) {
+			t.Errorf("expected command %q. Got %q", expected, command)
+		}
+	})
+}
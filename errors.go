@@ -4,14 +4,71 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
+	"strings"
 )
 
+// ErrorOutputLines is the number of trailing lines of a step's stdout and stderr that
+// are included in the error when the step fails.  A negative value includes all output.
+var ErrorOutputLines = 10
+
+// ChowError is a fatal error raised by the framework, such as a step that failed or a
+// path that could not be converted.  It is returned by Main, so that callers may inspect
+// it with a type assertion.
+//
+// Message describes what the framework was doing, such as "step failed", and Err is the
+// underlying cause.  Message may be empty.  Step is the step that caused the error, if
+// any, or the zero Step otherwise.
+type ChowError struct {
+	Message string
+	Err     error
+	Step    Step
+
+	// Additional context appended to the error, such as the tail of the step's output.
+	details string
+
+	// The exit code of the step that caused the error, or zero if it did not exit with a
+	// non-zero code.
+	exitCode int
+}
+
+func (e *ChowError) Error() string {
+	err := e.Err
+	if e.Message != "" {
+		err = fmt.Errorf("%s: %v", e.Message, e.Err)
+	}
+	return formatError("FATAL", err, e.Step).Error() + e.details
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *ChowError) Unwrap() error {
+	return e.Err
+}
+
 func logFatal(message string, err error, step Step) {
-	err = fmt.Errorf("%s: %v", message, err.Error())
-	formatted := formatError("FATAL", err, step)
-	panic(formatted)
+	panic(fatalError(message, err, step))
+}
+
+// Returns the error raised by logFatal.
+func fatalError(message string, err error, step Step) *ChowError {
+	return &ChowError{Message: message, Err: err, Step: step}
+}
+
+// Like fatalError, but also includes the tail of the step's captured output.
+func stepError(message string, err error, step Step, result StepResult) *ChowError {
+	b := new(bytes.Buffer)
+	writeOutputTail(b, "STDOUT", result.Stdout)
+	writeOutputTail(b, "STDERR", result.Stderr)
+	writeOutputTail(b, "COMBINED", result.Combined)
+	return &ChowError{
+		Message:  message,
+		Err:      err,
+		Step:     step,
+		details:  b.String(),
+		exitCode: result.ExitCode,
+	}
 }
 
 func logWarning(message string, step Step) {
@@ -29,3 +86,22 @@ func formatError(level string, err error, step Step) error {
 	fmt.Fprintln(b)
 	return errors.New(b.String())
 }
+
+// Writes the last ErrorOutputLines lines of output to w, noting whether any lines were
+// dropped.
+func writeOutputTail(w io.Writer, label, output string) {
+	if output == "" || ErrorOutputLines == 0 {
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if ErrorOutputLines > 0 && len(lines) > ErrorOutputLines {
+		fmt.Fprintf(w, "%s (truncated to the last %d of %d lines):\n",
+			label, ErrorOutputLines, len(lines))
+		lines = lines[len(lines)-ErrorOutputLines:]
+	} else {
+		fmt.Fprintf(w, "%s:\n", label)
+	}
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+	fmt.Fprintln(w)
+}
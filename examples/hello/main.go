@@ -3,6 +3,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"go.kendal.io/chow"
 )
@@ -12,7 +14,11 @@ var name string
 func main() {
 	flags := flag.FlagSet{}
 	flags.StringVar(&name, "name", "Anonymous", "The user to greet")
-	chow.Main(RunSteps, &flags)
+	result := chow.Run(RunSteps, &flags, chow.MainOptions{})
+	if result.Err != nil {
+		fmt.Fprint(os.Stderr, result.Err)
+	}
+	os.Exit(result.ExitCode)
 }
 
 func RunSteps(r chow.Runner) {
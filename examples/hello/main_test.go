@@ -18,6 +18,8 @@ func TestMain(t *testing.T) {
 	cfg := chow.TestConfig{Runnable: RunSteps}
 
 	t.Run("default", func(t *testing.T) {
-		cfg.Run(t, chow.TestCase{})
+		if err := cfg.Run(chow.TestCase{Name: "default"}); err != nil {
+			t.Fatal(err)
+		}
 	})
 }
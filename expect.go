@@ -0,0 +1,173 @@
+package chow
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+)
+
+// TestingT is the subset of testing.TB used by chow's assertion helpers.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Expect makes assertions about the steps run by an application under test.
+//
+// Example Usage:
+//
+//     chow.RunExpect(t, RunSteps, chow.TestCase{}).
+//         Step("build").
+//         HasCommand("make", "all").
+//         ExitCode(0)
+type Expect struct {
+	t    TestingT
+	logs []StepLog
+}
+
+// RunExpect runs r in test mode and returns an Expect for asserting on the steps it ran.
+//
+// No expectation file is generated.  tc.Output and tc.Args are ignored, since there are
+// no flags to parse them against; set flags directly before calling RunExpect instead.
+func RunExpect(t TestingT, r Runnable, tc TestCase) *Expect {
+	return &Expect{t: t, logs: runTest(r, tc).stepLogs}
+}
+
+// Logs returns the logs of all steps that were run.
+func (e *Expect) Logs() []StepLog {
+	return e.logs
+}
+
+// Step returns a StepExpect for the first step with the given name.
+//
+// If no such step ran, a test error is reported and all assertions on the returned
+// StepExpect are ignored.
+func (e *Expect) Step(name string) *StepExpect {
+	e.t.Helper()
+	for i := range e.logs {
+		if e.logs[i].StepName == name {
+			return &StepExpect{t: e.t, log: &e.logs[i]}
+		}
+	}
+	e.t.Errorf("expected a step named %q to run", name)
+	return &StepExpect{t: e.t}
+}
+
+// StepExpect makes assertions about a single step.  Its methods return the receiver so
+// that assertions can be chained.
+type StepExpect struct {
+	t   TestingT
+	log *StepLog
+}
+
+// HasCommand asserts that the step ran the given command.
+func (s *StepExpect) HasCommand(command ...string) *StepExpect {
+	s.t.Helper()
+	if s.log != nil && !reflect.DeepEqual(s.log.Step.Command, command) {
+		s.t.Errorf("step %q: expected command %q. Got %q",
+			s.log.StepName, command, s.log.Step.Command)
+	}
+	return s
+}
+
+// ExitCode asserts that the step exited with the given code.
+func (s *StepExpect) ExitCode(code int) *StepExpect {
+	s.t.Helper()
+	if s.log != nil && s.log.StepResult.ExitCode != code {
+		s.t.Errorf("step %q: expected exit code %d. Got %d",
+			s.log.StepName, code, s.log.StepResult.ExitCode)
+	}
+	return s
+}
+
+// Stdout asserts that the step wrote the given stdout.
+func (s *StepExpect) Stdout(stdout string) *StepExpect {
+	s.t.Helper()
+	if s.log != nil && s.log.StepResult.Stdout != stdout {
+		s.t.Errorf("step %q: expected stdout %q. Got %q",
+			s.log.StepName, stdout, s.log.StepResult.Stdout)
+	}
+	return s
+}
+
+// AssertCommandContainsArgs asserts that the step named stepName ran a command
+// containing args, in order, though not necessarily adjacent to one another.
+//
+// This is more robust than comparing the entire command when only some arguments matter.
+// args may use the framework's path syntax.
+func AssertCommandContainsArgs(t TestingT, logs []StepLog, stepName string, args ...string) {
+	t.Helper()
+	simulated := make([]string, len(args))
+	for i, arg := range args {
+		simulated[i] = simulatedPath(arg)
+	}
+	args = simulated
+	for _, log := range logs {
+		if log.StepName != stepName {
+			continue
+		}
+		if !containsInOrder(log.Step.Command, args) {
+			t.Errorf("step %q: expected command %q to contain %q",
+				stepName, log.Step.Command, args)
+		}
+		return
+	}
+	t.Errorf("expected a step named %q to run", stepName)
+}
+
+// AssertFileMode asserts that the most recent step to produce the output at path
+// recorded it with the permissions of mode.
+//
+// Only permission bits are compared.  In production, output modes are only logged with
+// -chow.record_output_modes.  In tests, they are given by Mock.Modes, and path may use
+// the framework's path syntax.
+func AssertFileMode(t TestingT, logs []StepLog, path string, mode os.FileMode) {
+	t.Helper()
+	path = simulatedPath(path)
+	for i := len(logs) - 1; i >= 0; i-- {
+		actual, ok := logs[i].OutputModes[path]
+		if !ok {
+			continue
+		}
+		if actual.Perm() != mode.Perm() {
+			t.Errorf("step %q: expected %s to have mode %v. Got %v",
+				logs[i].StepName, path, mode.Perm(), actual.Perm())
+		}
+		return
+	}
+	t.Errorf("expected a step to produce %s", path)
+}
+
+// Reports whether all of want appear in have, in the same order.
+func containsInOrder(have, want []string) bool {
+	i := 0
+	for _, arg := range have {
+		if i < len(want) && arg == want[i] {
+			i++
+		}
+	}
+	return i == len(want)
+}
+
+// AssertDeterministic runs r twice and reports a test error if the two runs produce
+// different expectations.
+//
+// Expectations are compared after trimming trailing whitespace from step output.  This
+// catches accidental nondeterminism such as map iteration order or timestamps.
+func AssertDeterministic(t TestingT, r Runnable, tc TestCase) {
+	t.Helper()
+
+	var expectations [2]bytes.Buffer
+	for i := range expectations {
+		logs := TrimTrailingWhitespace.normalize(runTest(r, tc).stepLogs)
+		if err := encodeExpectation(&expectations[i], logs); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+
+	if !bytes.Equal(expectations[0].Bytes(), expectations[1].Bytes()) {
+		t.Errorf("expectations differ between runs:\nfirst: %s\nsecond: %s",
+			expectations[0].String(), expectations[1].String())
+	}
+}
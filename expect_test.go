@@ -0,0 +1,211 @@
+package chow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// A TestingT that records errors instead of failing the test.
+type fakeT struct {
+	errors []string
+}
+
+func (*fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRunExpect(t *testing.T) {
+	runnable := func(r Runner) {
+		r.Run("build", Step{Command: []string{"make", "all"}})
+		r.Run("test", Step{Command: []string{"make", "test"}})
+	}
+	tc := TestCase{Mocks: []Mock{{
+		Step:   "test",
+		Result: StepResult{Stdout: "FAIL", ExitCode: 1},
+	}}}
+
+	t.Run("should pass chained assertions that hold", func(t *testing.T) {
+		ft := &fakeT{}
+		e := RunExpect(ft, runnable, tc)
+		e.Step("build").HasCommand("make", "all").ExitCode(0)
+		e.Step("test").HasCommand("make", "test").Stdout("FAIL").ExitCode(1)
+
+		if len(ft.errors) > 0 {
+			t.Errorf("expected no errors. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should report a failed assertion", func(t *testing.T) {
+		ft := &fakeT{}
+		RunExpect(ft, runnable, tc).Step("test").HasCommand("make", "test").ExitCode(0)
+
+		if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "exit code") {
+			t.Errorf("expected one exit code error. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should report a missing step", func(t *testing.T) {
+		ft := &fakeT{}
+		RunExpect(ft, runnable, tc).Step("deploy").ExitCode(0)
+
+		if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "deploy") {
+			t.Errorf("expected one missing step error. Got %v", ft.errors)
+		}
+	})
+}
+
+func TestAssertDeterministic(t *testing.T) {
+	t.Run("should pass for a deterministic recipe", func(t *testing.T) {
+		ft := &fakeT{}
+		AssertDeterministic(ft, func(r Runner) {
+			r.Run("build", Step{Command: []string{"make"}})
+		}, TestCase{Mocks: []Mock{{Step: "build", Result: StepResult{Stdout: "ok"}}}})
+
+		if len(ft.errors) > 0 {
+			t.Errorf("expected no errors. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should pass for a recipe that uses placeholders", func(t *testing.T) {
+		ft := &fakeT{}
+		AssertDeterministic(ft, func(r Runner) {
+			r.Run("build", Step{Command: []string{"make", "-f", Placeholder("all:")}})
+		}, TestCase{})
+
+		if len(ft.errors) > 0 {
+			t.Errorf("expected no errors. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should fail for a nondeterministic recipe", func(t *testing.T) {
+		ft := &fakeT{}
+		runs := 0
+		AssertDeterministic(ft, func(r Runner) {
+			runs++
+			r.Run("build", Step{Command: []string{"make", fmt.Sprint(runs)}})
+		}, TestCase{})
+
+		if len(ft.errors) != 1 {
+			t.Errorf("expected one error. Got %v", ft.errors)
+		}
+	})
+}
+
+func TestAssertCommandContainsArgs(t *testing.T) {
+	logs := RunExpect(t, func(r Runner) {
+		r.Run("build", Step{Command: []string{"go", "build", "-v", "-o", "out", "./..."}})
+	}, TestCase{}).Logs()
+
+	t.Run("should pass if the command contains the args", func(t *testing.T) {
+		ft := &fakeT{}
+		AssertCommandContainsArgs(ft, logs, "build", "build", "-o", "out")
+
+		if len(ft.errors) > 0 {
+			t.Errorf("expected no errors. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should fail if an arg is missing", func(t *testing.T) {
+		ft := &fakeT{}
+		AssertCommandContainsArgs(ft, logs, "build", "-o", "-race")
+
+		if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "-race") {
+			t.Errorf("expected one error naming the missing arg. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should fail if the args are out of order", func(t *testing.T) {
+		ft := &fakeT{}
+		AssertCommandContainsArgs(ft, logs, "build", "out", "-o")
+
+		if len(ft.errors) != 1 {
+			t.Errorf("expected one error. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should fail if the step did not run", func(t *testing.T) {
+		ft := &fakeT{}
+		AssertCommandContainsArgs(ft, logs, "test", "-v")
+
+		if len(ft.errors) != 1 {
+			t.Errorf("expected one error. Got %v", ft.errors)
+		}
+	})
+}
+
+func TestAssertFileMode(t *testing.T) {
+	t.Run("should use the modes of mocked outputs", func(t *testing.T) {
+		logs := RunExpect(t, func(r Runner) {
+			r.Run("package", Step{Command: []string{"tar", "xf", "pkg.tar"}})
+		}, TestCase{Mocks: []Mock{{
+			Step:  "package",
+			Modes: map[string]os.FileMode{"//CWD/bin/tool": 0755},
+		}}}).Logs()
+
+		ft := &fakeT{}
+		AssertFileMode(ft, logs, "//CWD/bin/tool", 0755)
+		AssertFileMode(ft, logs, "//CWD/bin/tool", 0644)
+		AssertFileMode(ft, logs, "//CWD/bin/other", 0755)
+
+		if len(ft.errors) != 2 {
+			t.Errorf("expected two errors. Got %v", ft.errors)
+		}
+	})
+
+	t.Run("should use the modes of produced outputs", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("File modes are not supported on Windows")
+		}
+
+		echoPath := buildTestBinary(t, "echo")
+		defer os.RemoveAll(echoPath)
+
+		if err := ioutil.WriteFile("mode.txt", nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove("mode.txt")
+		if err := os.Chmod("mode.txt", 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		startDir, _ := os.Getwd()
+		var stepOutput bytes.Buffer
+		runner := &prodRunner{
+			startDir:          startDir,
+			stdout:            new(bytes.Buffer),
+			stderr:            os.Stderr,
+			stepOutput:        &stepOutput,
+			recordOutputModes: true,
+		}
+		runner.Run("", Step{
+			Command: []string{"./" + echoPath},
+			Outputs: []string{"//CWD/mode.txt"},
+		})
+
+		var log StepLog
+		if err := json.NewDecoder(&stepOutput).Decode(&log); err != nil {
+			t.Fatalf("failed to decode step output: %v", err)
+		}
+		path := filepath.Join(startDir, "mode.txt")
+
+		ft := &fakeT{}
+		AssertFileMode(ft, []StepLog{log}, path, 0640)
+		if len(ft.errors) > 0 {
+			t.Errorf("expected no errors. Got %v", ft.errors)
+		}
+
+		AssertFileMode(ft, []StepLog{log}, path, 0600)
+		if len(ft.errors) != 1 {
+			t.Errorf("expected one error. Got %v", ft.errors)
+		}
+	})
+}
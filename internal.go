@@ -2,34 +2,160 @@ package chow
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
-var placeholders map[string]io.WriteCloser
+var (
+	// The paths of the backing files or directories of the placeholders created so far,
+	// by ID.  Guarded by placeholdersMu, since placeholders may be created concurrently.
+	placeholders   = make(map[string]string)
+	placeholdersMu sync.Mutex
 
-// stepLog describes a step invocation.
-//
-// This is logged to the console in production and serialized into an
-// expectation file when testing.
-type stepLog struct {
-	StepName   string     `json:"step_name"`
-	Step       Step       `json:"step"`
-	StepResult StepResult `json:"result"`
+	// The number of placeholders created so far.  Used to generate unique IDs.
+	placeholderCount int64
+)
+
+// renameCommand is the command recorded in the step log for Runner.Rename.
+const renameCommand = "chow.rename"
+
+// assertExistsCommand is the command recorded in the step log for Runner.AssertExists.
+const assertExistsCommand = "chow.assert_exists"
+
+// writeFileCommand is the command recorded in the step log for Runner.WriteFile.
+const writeFileCommand = "chow.write_file"
+
+// stdinMarker is recorded in production step logs for steps that were given stdin.
+const stdinMarker = "[stdin]"
+
+func runMain(r Runnable, f *flag.FlagSet, args []string, mainOpts MainOptions) error {
+	return mainResult(r, f, args, mainOpts).Err
+}
+
+// Like runMain, but returns the result of the run.
+func mainResult(r Runnable, f *flag.FlagSet, args []string, mainOpts MainOptions) RunResult {
+	defer ResetPlaceholders()
+
+	if f == nil {
+		f = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	}
+
+	// Report parse errors to the caller rather than exiting, and restore the caller's
+	// error handling afterwards.
+	defer f.Init(f.Name(), f.ErrorHandling())
+	f.Init(f.Name(), flag.ContinueOnError)
+
+	if mainOpts.Stdout == nil {
+		mainOpts.Stdout = os.Stdout
+	}
+	if mainOpts.Stderr == nil {
+		mainOpts.Stderr = os.Stderr
+	}
+
+	ctx := mainOpts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer cancelOnSecondInterrupt(cancel)()
+
+	opts := options{stepLog: mainOpts.StepLog, logWriter: mainOpts.LogWriter, ctx: ctx}
+	opts.register(f)
+	if err := f.Parse(args); err != nil {
+		return RunResult{ExitCode: 2, Err: &ChowError{Message: "failed to parse flags", Err: err}}
+	}
+	return runResult(r, mainOpts.Stdout, mainOpts.Stderr, opts)
+}
+
+// Calls cancel when the process receives its second interrupt.  The first is left to the
+// running step, which shares the process's terminal and so receives it too.  While this
+// listens, interrupts no longer stop the process itself.  Returns a function that stops
+// listening for interrupts.
+func cancelOnSecondInterrupt(cancel context.CancelFunc) func() {
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		count := 0
+		for {
+			select {
+			case <-interrupts:
+				if count++; count == 2 {
+					cancel()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(interrupts)
+		close(done)
+	}
+}
+
+// Returns the exit code of a run that failed with err.  This is the exit code of the step
+// that failed the run, if any, or 1 otherwise.  Negative exit codes, such as
+// TimeoutExitCode, are also reported as 1 so that they may be used as a process's status.
+func exitCodeOfError(err error) int {
+	if chowErr, ok := err.(*ChowError); ok && chowErr.exitCode > 0 {
+		return chowErr.exitCode
+	}
+	return 1
 }
 
-func runRunnable(r Runnable, stdout io.Writer, stderr io.Writer) (err error) {
-	// The framework will panic if any fatal errors occur. Recover from these panics so we
-	// can report errors gracefully.
+func runRunnable(r Runnable, stdout io.Writer, stderr io.Writer, opts options) error {
+	return runResult(r, stdout, stderr, opts).Err
+}
+
+// Like runRunnable, but returns the result of the run.
+func runResult(r Runnable, stdout io.Writer, stderr io.Writer, opts options) (result RunResult) {
+	var runner *prodRunner
+
+	// Runnables cannot return errors, so the framework panics with a *ChowError if any
+	// fatal errors occur.  Recover from these panics so we can report errors gracefully,
+	// but let any other panic propagate, since it is a bug rather than a failed run.
 	defer func() {
 		if r := recover(); r != nil {
-			err = r.(error)
+			chowErr, ok := r.(*ChowError)
+			if !ok {
+				panic(r)
+			}
+			result.Err = chowErr
+		}
+		if runner != nil {
+			result.Summary = runner.summary
+		}
+
+		// Write the summary even if the run failed, since that is when it is most useful.
+		if runner != nil && opts.summaryPath != "" {
+			if err := runner.summary.writeFile(opts.summaryPath); err != nil && result.Err == nil {
+				result.Err = &ChowError{Err: err}
+			}
+		}
+		if result.Err != nil {
+			result.ExitCode = exitCodeOfError(result.Err)
 		}
 	}()
 
@@ -38,15 +164,51 @@ func runRunnable(r Runnable, stdout io.Writer, stderr io.Writer) (err error) {
 		logFatal("failed to get working directory", err, Step{})
 	}
 
-	runner := &prodRunner{
-		startDir:   startDir,
-		stdout:     stdout,
-		stderr:     stderr,
-		stepOutput: stdout,
+	stepOutput := opts.stepLog
+	if stepOutput == nil {
+		stepOutput = stdout
+	}
+
+	runner = &prodRunner{
+		startDir:          startDir,
+		stdout:            stdout,
+		stderr:            stderr,
+		stepOutput:        stepOutput,
+		logWriter:         opts.logWriter,
+		recordOnly:        opts.recordPath != "" || opts.dryRun,
+		verbose:           opts.verbose,
+		defaultTimeout:    opts.timeout,
+		recordEnv:         opts.recordEnv,
+		hashOutputs:       opts.hashOutputs,
+		recordOutputModes: opts.recordOutputModes,
+		recordOutputTimes: opts.recordOutputTimes,
+		guardStartDir:     opts.guardStartDir,
+		parallelism:       opts.parallelism,
+		properties:        opts.properties,
+		ctx:               opts.ctx,
 	}
 
 	// Run the program.
+	defer setActiveRunner(runner)()
 	r(runner)
+
+	if err := runner.context().Err(); err != nil {
+		logFatal("run cancelled", err, Step{})
+	}
+
+	if opts.recordPath != "" {
+		writeRecord(opts.recordPath, runner.recorded)
+	}
+
+	// Only runs that use phases or log files follow their step logs with the summary.  See
+	// MainOptions.
+	if len(runner.summary.Phases) > 0 || len(runner.summary.LogFiles) > 0 {
+		encoder := json.NewEncoder(runner.stepOutput)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(runner.summary); err != nil {
+			logFatal("failed to log run summary", err, Step{})
+		}
+	}
 	return
 }
 
@@ -56,166 +218,1982 @@ type prodRunner struct {
 	stdout      io.Writer
 	stderr      io.Writer
 	stepOutput  io.Writer
+	summary     RunSummary
+
+	// Receives the log of each step.  Defaults to writing JSON to stepOutput.
+	logWriter LogWriter
+
+	// Resolves the binary named by a step's command to an executable path.  Defaults to
+	// exec.LookPath.  Tests may replace this to simulate present or missing binaries.
+	lookPath func(file string) (string, error)
+
+	// Returns the user's home directory.  Defaults to os.UserHomeDir.  Tests may replace
+	// this to simulate a missing home directory.
+	userHomeDir func() (string, error)
+
+	// If true, steps are logged and recorded but not run, and assertions about the files
+	// they would have produced are skipped.
+	recordOnly bool
+	recorded   []StepLog
+
+	// If true, each step's resolved command is printed to stderr before it runs.
+	verbose bool
+
+	// The timeout for steps that do not specify one.  Zero means no timeout.
+	defaultTimeout time.Duration
+
+	// Whether to record each step's environment in its log.
+	recordEnv bool
+
+	// Whether to record the digests of each step's outputs in its log.
+	hashOutputs bool
+
+	// Whether to record the modes of each step's outputs in its log.
+	recordOutputModes bool
+
+	// Whether to record the modification times of each step's outputs in its log.
+	recordOutputTimes bool
+
+	// Whether to fail steps that create or modify files in the start directory that
+	// were not declared as outputs.
+	guardStartDir bool
+
+	// The maximum number of steps RunParallel runs at once.  Zero means no limit.
+	parallelism int
+
+	// The application's properties, as a JSON object.
+	properties string
+
+	// Cancels the run when done.  Nil means the run cannot be cancelled.
+	ctx context.Context
+
+	// The runner this one was cloned from to run a step concurrently with others, if
+	// any.  Step logs and the run summary are recorded by the parent.
+	parent *prodRunner
+
+	// The outputs of the steps run concurrently with this one, if any.  Files they
+	// produce are not attributed to this step by ForbidOutputs or -chow.guard_start_dir.
+	batchOutputs *batchOutputs
+
+	// Guards the step logs and run summary while steps run concurrently.
+	mu sync.Mutex
 }
 
 // Run implements Runner
 func (r *prodRunner) Run(name string, step Step) StepResult {
+	return r.RunWithStdin(name, step, nil)
+}
+
+// RunWithStdin implements Runner
+func (r *prodRunner) RunWithStdin(name string, step Step, stdin io.Reader) StepResult {
+	result, err := r.run(name, step, stdin)
+	if err != nil {
+		// Runnables cannot return errors, so unwind the Runnable to report the error.
+		panic(err)
+	}
+	return result
+}
+
+// TryRun implements Runner
+func (r *prodRunner) TryRun(name string, step Step) (StepResult, error) {
+	return r.run(name, step, nil)
+}
+
+// Runs the step, returning a *ChowError if it fails.
+func (r *prodRunner) run(name string, step Step, stdin io.Reader) (StepResult, error) {
+	if r.context().Err() != nil {
+		return StepResult{ExitCode: CancelledExitCode}, nil
+	}
+
 	r.currentStep = step
+	if len(r.currentStep.Command) == 0 {
+		return StepResult{}, fatalError("invalid step", errors.New("empty command"), r.currentStep)
+	}
+	if r.currentStep.ExpandEnv {
+		r.currentStep.Command = expandEnv(r.currentStep.Command, stepEnv(r.currentStep))
+	}
 
 	if err := r.convertAnyPaths(r.currentStep.Command); err != nil {
-		logFatal("failed to convert paths in step command", err, r.currentStep)
+		return StepResult{}, fatalError("failed to convert paths in step command", err, r.currentStep)
 	}
 	if err := r.convertAnyPaths(r.currentStep.Outputs); err != nil {
-		logFatal("failed to convert paths in step outputs", err, r.currentStep)
+		return StepResult{}, fatalError("failed to convert paths in step outputs", err, r.currentStep)
+	}
+	r.batchOutputs.add(r.currentStep.Outputs)
+	if err := r.convertAnyPaths(r.currentStep.ForbidOutputs); err != nil {
+		return StepResult{}, fatalError("failed to convert paths in step forbidden outputs", err, r.currentStep)
+	}
+	env, err := r.convertMapPaths(r.currentStep.Env)
+	if err != nil {
+		return StepResult{}, fatalError("failed to convert paths in step env", err, r.currentStep)
+	}
+	r.currentStep.Env = env
+	logFiles, err := r.convertMapPaths(r.currentStep.LogFiles)
+	if err != nil {
+		return StepResult{}, fatalError("failed to convert paths in step log files", err, r.currentStep)
+	}
+	r.currentStep.LogFiles = logFiles
+	if r.currentStep.StreamOutputTo != "" {
+		path := []string{r.currentStep.StreamOutputTo}
+		if err := r.convertAnyPaths(path); err != nil {
+			return StepResult{}, fatalError("failed to convert step output file", err, r.currentStep)
+		}
+		r.currentStep.StreamOutputTo = path[0]
+	}
+	if r.currentStep.Dir != "" {
+		dir := []string{r.currentStep.Dir}
+		if err := r.convertAnyPaths(dir); err != nil {
+			return StepResult{}, fatalError("failed to convert step dir", err, r.currentStep)
+		}
+		r.currentStep.Dir = dir[0]
+	}
+	if r.currentStep.Stdin != "" && stdin != nil {
+		return StepResult{}, fatalError("invalid step", errors.New("stdin given twice"), r.currentStep)
+	}
+
+	// Check the filesystem only once the step is certain to run, since the files a step
+	// needs may be produced by earlier steps that were only recorded.
+	if r.recordOnly {
+		log := StepLog{StepName: name, Step: r.currentStep}
+		r.logStep(log)
+		return log.StepResult, nil
+	}
+
+	if r.currentStep.Dir != "" {
+		if info, err := os.Stat(r.currentStep.Dir); err != nil {
+			return StepResult{}, fatalError("failed to find step dir", err, r.currentStep)
+		} else if !info.IsDir() {
+			err := fmt.Errorf("%s is not a directory", r.currentStep.Dir)
+			return StepResult{}, fatalError("failed to find step dir", err, r.currentStep)
+		}
+	}
+	if r.currentStep.Stdin != "" {
+		var err error
+		if stdin, err = stepStdin(r.currentStep); err != nil {
+			return StepResult{}, fatalError("failed to read step stdin", err, r.currentStep)
+		}
+	}
+
+	binary, err := r.resolveBinary(r.currentStep.Command[0])
+	if err != nil {
+		return StepResult{}, fatalError("failed to find binary", err, r.currentStep)
+	}
+
+	childEnv := stepEnv(r.currentStep)
+
+	// Buffer stdin if the step may be retried, so that every attempt reads all of it.
+	attemptStdin := func() io.Reader { return stdin }
+	if stdin != nil && r.currentStep.Retries > 0 {
+		contents, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return StepResult{}, fatalError("failed to read step stdin", err, r.currentStep)
+		}
+		attemptStdin = func() io.Reader { return bytes.NewReader(contents) }
+	}
+
+	forbidden := statAll(r.currentStep.ForbidOutputs)
+	var existing map[string]bool
+	if r.currentStep.RemoveOutputsOnFailure {
+		existing = existingPaths(expandOutputs(r.currentStep.Outputs))
+	}
+	var snapshot map[string]os.FileInfo
+	if r.guardStartDir {
+		if snapshot, err = statTree(r.startDir); err != nil {
+			return StepResult{}, fatalError("failed to snapshot start dir", err, r.currentStep)
+		}
+	}
+
+	if r.verbose {
+		fmt.Fprintf(r.stderr, "chow: running %q: %s\n", name, joinCommand(r.currentStep.Command))
+	}
+
+	ctx := r.context()
+	if r.currentStep.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.currentStep.TotalTimeout)
+		defer cancel()
+	}
+	timeout := r.timeout(r.currentStep)
+
+	var result StepResult
+	var attempts int
+	var limit string
+	start := time.Now()
+	for {
+		attempts++
+		var timedOut bool
+		result, timedOut, err = r.runAttempt(ctx, timeout, binary, childEnv, attemptStdin())
+		if err != nil {
+			return StepResult{}, err
+		}
+
+		// Check the run's context first, since its deadline also expires ctx.  Only the
+		// step's own timeouts are reported as such.
+		switch {
+		case result.ExitCode != 0 && r.context().Err() != nil:
+			result.ExitCode = CancelledExitCode
+		case r.currentStep.TotalTimeout > 0 && ctx.Err() == context.DeadlineExceeded:
+			result.ExitCode, limit = TimeoutExitCode, totalTimeoutLimit
+		case timedOut:
+			result.ExitCode, limit = TimeoutExitCode, attemptTimeoutLimit
+		}
+
+		done := result.ExitCode == 0 || result.ExitCode == CancelledExitCode ||
+			limit == totalTimeoutLimit || attempts > r.currentStep.Retries
+		if done {
+			break
+		}
+		limit = ""
+		if r.verbose {
+			fmt.Fprintf(r.stderr, "chow: retrying %q after exit code %d (attempt %d of %d)\n",
+				name, result.ExitCode, attempts+1, r.currentStep.Retries+1)
+		}
+	}
+	result.Duration = time.Since(start)
+	r.updateSummary(func(s *RunSummary) { s.recordStep(name, result) })
+
+	log := StepLog{
+		StepName:   name,
+		Step:       r.currentStep,
+		StepResult: result,
+	}
+	if r.recordEnv {
+		log.Env = redactEnv(childEnv)
+	}
+	if stdin != nil {
+		log.Stdin = stdinMarker
+	}
+	if r.currentStep.Retries > 0 {
+		log.Attempts = attempts
+	}
+	log.TimeoutLimit = limit
+
+	if result.ExitCode != 0 && r.currentStep.RemoveOutputsOnFailure {
+		if err := removeOutputs(existing, expandOutputs(r.currentStep.Outputs)); err != nil {
+			return result, stepError("failed to remove outputs", err, r.currentStep, result)
+		}
+	}
+
+	// The run fails once the Runnable returns, so that it may clean up after itself.
+	if result.ExitCode == CancelledExitCode {
+		r.logStep(log)
+		return result, nil
 	}
+	if result.ExitCode == TimeoutExitCode {
+		r.logStep(log)
+		err := fmt.Errorf("attempt timed out: killed after %v", timeout)
+		if limit == totalTimeoutLimit {
+			err = fmt.Errorf("total budget exhausted: killed after %v across %d attempts",
+				r.currentStep.TotalTimeout, attempts)
+		}
+		return result, stepError("step timed out", err, r.currentStep, result)
+	}
+	if result.ExitCode != 0 && r.currentStep.FailOnNonZeroExit {
+		r.logStep(log)
+		err := fmt.Errorf("exited with code %d", result.ExitCode)
+		return result, stepError("step failed", err, r.currentStep, result)
+	}
+
+	// Only steps that succeed are required to produce their outputs.
+	outputs := r.currentStep.Outputs
+	if result.ExitCode == 0 {
+		if outputs, err = r.checkOutputs(result); err != nil {
+			return result, err
+		}
+		if r.recordOutputModes {
+			log.OutputModes = fileModes(outputs)
+		}
+		if r.recordOutputTimes {
+			log.OutputTimes = fileTimes(outputs)
+		}
+	}
+	if err := r.checkForbiddenOutputs(forbidden, result); err != nil {
+		return result, err
+	}
+	if r.guardStartDir {
+		if err := r.checkStartDir(snapshot, outputs, result); err != nil {
+			return result, err
+		}
+	}
+
+	if r.hashOutputs && result.ExitCode == 0 {
+		digests, err := hashFiles(outputs)
+		if err != nil {
+			return result, stepError("failed to hash outputs", err, r.currentStep, result)
+		}
+		log.OutputDigests = digests
+	}
+
+	r.checkLogFiles()
+	r.updateSummary(func(s *RunSummary) { s.recordLogFiles(name, r.currentStep.LogFiles) })
+
+	// Log the result
+	r.logStep(log)
+	return log.StepResult, nil
+}
+
+// The values of StepLog.TimeoutLimit, naming the limit that killed a step.
+const (
+	attemptTimeoutLimit = "timeout"
+	totalTimeoutLimit   = "total_timeout"
+)
 
-	child := exec.Command(r.currentStep.Command[0], r.currentStep.Command[1:]...)
+// Runs a single attempt of the current step's command, killing it once ctx is done or
+// timeout has elapsed, if it is positive.  Reports whether the attempt timed out.  The
+// result's exit code is the command's own.
+func (r *prodRunner) runAttempt(ctx context.Context, timeout time.Duration, binary string,
+	env []string, stdin io.Reader) (StepResult, bool, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	child := exec.CommandContext(ctx, binary, r.currentStep.Command[1:]...)
+	child.Args[0] = r.currentStep.Command[0]
+	child.Env = env
+	child.Dir = r.currentStep.Dir
+	child.Stdin = stdin
 
 	// Capture stdout & stderr. We still want to print the child's output for easy
 	// debugging, so we also stream to the current stdout and stderr.
-	outWriter := &recordingWriter{Delegate: r.stdout}
-	errWriter := &recordingWriter{Delegate: r.stderr}
+	max := r.currentStep.MaxOutputBytes
+	outWriter := &recordingWriter{Delegate: r.stdout, Max: max}
+	errWriter := &recordingWriter{Delegate: r.stderr, Max: max}
 	child.Stdout = outWriter
 	child.Stderr = errWriter
 
+	// Share a single writer between both streams so that their order is preserved.
+	combinedWriter := &recordingWriter{Delegate: r.stdout, Max: max}
+	if r.currentStep.Combined {
+		child.Stdout = combinedWriter
+		child.Stderr = combinedWriter
+	}
+
+	// Write the full output to the step's output file, and keep only its tail in memory.
+	if r.currentStep.StreamOutputTo != "" {
+		file, err := os.Create(r.currentStep.StreamOutputTo)
+		if err != nil {
+			return StepResult{}, false, fatalError("failed to create step output file", err, r.currentStep)
+		}
+		defer file.Close()
+
+		outWriter.Limit = StreamedOutputTail
+		combinedWriter.Limit = StreamedOutputTail
+		child.Stdout = io.MultiWriter(child.Stdout, file)
+		if r.currentStep.Combined {
+			child.Stderr = child.Stdout
+		}
+	}
+
+	start := time.Now()
 	if err := child.Start(); err != nil {
-		logFatal("failed to start child process", err, r.currentStep)
+		return StepResult{}, false, fatalError("failed to start child process", err, r.currentStep)
 	}
 
-	var exitCode int
-	if err := child.Wait(); err != nil {
-		exitCode = err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	exitCode, err := exitCodeOf(child.Wait())
+	if err != nil {
+		return StepResult{}, false, fatalError("failed to run child process", err, r.currentStep)
 	}
 
-	// Ensure outputs exist, fail otherwise.
-	var missingOutputs []string
-	for _, output := range r.currentStep.Outputs {
-		_, err := os.Stat(output)
-		if err != nil && os.IsNotExist(err) {
-			missingOutputs = append(missingOutputs, output)
+	result := StepResult{
+		Stdout:   outWriter.String(),
+		Stderr:   errWriter.String(),
+		Combined: combinedWriter.String(),
+		ExitCode: exitCode,
+		Duration: time.Since(start),
+	}
+	return result, timeout > 0 && ctx.Err() == context.DeadlineExceeded, nil
+}
+
+// Returns the context that cancels the run.
+func (r *prodRunner) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Warns about any of the current step's log files that do not exist.
+func (r *prodRunner) checkLogFiles() {
+	for label, path := range r.currentStep.LogFiles {
+		if _, err := os.Stat(path); err != nil {
+			logWarning(fmt.Sprintf("missing log file %q: %v", label, err), r.currentStep)
 		}
 	}
+}
 
-	if len(missingOutputs) > 0 {
-		err := fmt.Errorf("ouputs are missing: %#v", missingOutputs)
-		logFatal("declared outputs missing after step execution", err, r.currentStep)
+// Returns a copy of m with any paths in its values converted, since m belongs to the
+// caller.  Returns nil if m is empty.
+func (r *prodRunner) convertMapPaths(m map[string]string) (map[string]string, error) {
+	if len(m) == 0 {
+		return nil, nil
 	}
 
-	// Log the result
-	stepLog := stepLog{
-		StepName: name,
-		Step:     r.currentStep,
-		StepResult: StepResult{
-			Stdout:   outWriter.String(),
-			Stderr:   errWriter.String(),
-			ExitCode: exitCode,
-		},
+	converted := make(map[string]string, len(m))
+	for key, value := range m {
+		values := []string{value}
+		if err := r.convertAnyPaths(values); err != nil {
+			return nil, err
+		}
+		converted[key] = values[0]
 	}
+	return converted, nil
+}
 
-	encoder := json.NewEncoder(r.stepOutput)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(stepLog); err != nil {
-		logFatal("failed to log step", err, r.currentStep)
+// Returns the exit code of a child process, given the error returned by waiting for it.
+//
+// If the process was killed by a signal, the exit code is the negated signal number.
+// An error is returned if the process did not exit normally or by a signal.
+func exitCodeOf(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, err
 	}
 
-	return stepLog.StepResult
+	if status.Signaled() {
+		return -int(status.Signal()), nil
+	}
+	return status.ExitStatus(), nil
 }
 
-// Converts the input path to an absolute path for the current platform.
-func (r *prodRunner) convertAnyPaths(args []string) error {
-	for i, p := range args {
-		// Current working directory
-		if strings.HasPrefix(p, "//cwd/") {
-			wd, err := os.Getwd()
+// Ensures the current step's outputs exist, and are non-empty if required.  Returns an
+// error otherwise.  Returns the paths of the outputs, with any patterns expanded.
+func (r *prodRunner) checkOutputs(result StepResult) ([]string, error) {
+	var outputs, missingOutputs, emptyOutputs []string
+	for _, output := range r.currentStep.Outputs {
+		paths := []string{output}
+		if strings.ContainsAny(output, "*?[") {
+			matches, err := filepath.Glob(output)
 			if err != nil {
-				return fmt.Errorf("failed to get cwd: %v", err)
+				return nil, fatalError("invalid output pattern", err, r.currentStep)
 			}
+			paths = matches
+		}
 
-			suffix := strings.SplitN(p, "//cwd/", 2)[1]
-			args[i] = filepath.FromSlash(wd + "/" + suffix)
-			continue
+		if len(paths) == 0 {
+			missingOutputs = append(missingOutputs, output)
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil && os.IsNotExist(err) {
+				missingOutputs = append(missingOutputs, path)
+			} else if err == nil && !info.IsDir() && info.Size() == 0 {
+				emptyOutputs = append(emptyOutputs, path)
+			}
+			outputs = append(outputs, path)
 		}
+	}
+
+	if len(missingOutputs) > 0 {
+		err := fmt.Errorf("ouputs are missing: %#v", missingOutputs)
+		return nil, stepError("declared outputs missing after step execution", err, r.currentStep, result)
+	}
+	if r.currentStep.RequireNonEmptyOutputs && len(emptyOutputs) > 0 {
+		err := fmt.Errorf("outputs are empty: %#v", emptyOutputs)
+		return nil, stepError("declared outputs empty after step execution", err, r.currentStep, result)
+	}
+	return outputs, nil
+}
 
-		// Placeholder
-		if strings.HasPrefix(p, "//ph/") {
-			id := strings.SplitN(p, "//ph/", 2)[1]
-			file := placeholders[id]
-			// TODO: Find a way to close the file handle.
-			args[i] = file.(*os.File).Name()
+// Returns the sha256 digests of the given files, by path.  Directories are skipped.
+func hashFiles(paths []string) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
 			continue
 		}
 
-		// Start dir
-		if strings.HasPrefix(p, "///") {
-			suffix := strings.SplitN(p, "///", 2)[1]
-			r.startDir = strings.TrimRight(r.startDir, "/")
-			args[i] = filepath.FromSlash(r.startDir + "/" + suffix)
-			continue
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
 		}
+		digests[path] = digest(contents)
+	}
+	return digests, nil
+}
 
-		// Ignore absolute paths, relative paths and non-path arguments.
+// Returns the modes of the given files, by path, or nil if there are none.  Files that
+// cannot be read are skipped.
+func fileModes(paths []string) map[string]os.FileMode {
+	var modes map[string]os.FileMode
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if modes == nil {
+			modes = make(map[string]os.FileMode)
+		}
+		modes[path] = info.Mode()
 	}
+	return modes
+}
 
-	return nil
+// Returns the modification times of the given files, by path, or nil if there are none.
+// Files that cannot be read are skipped.
+func fileTimes(paths []string) map[string]time.Time {
+	var times map[string]time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if times == nil {
+			times = make(map[string]time.Time)
+		}
+		times[path] = info.ModTime()
+	}
+	return times
 }
 
-// A Runner that records step invocations for testing.
-//
-// This generates an "expectation", which is a serialized chain of step logs
-// representing the set of commands that would run in production.
-type testRunner struct {
-	Mocks      []Mock
-	callCounts map[string]int
-	stepLogs   []stepLog
+// Returns the hex-encoded sha256 digest of contents.
+func digest(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
 }
 
-// Run implements Runner
-//
-// This is called directly by the client's production code.
-func (r *testRunner) Run(name string, step Step) StepResult {
-	if r.callCounts == nil {
-		r.callCounts = make(map[string]int)
+// Ensures none of the current step's forbidden outputs were created or modified, given
+// their states before the step ran.  Returns an error otherwise.
+func (r *prodRunner) checkForbiddenOutputs(before map[string]os.FileInfo, result StepResult) error {
+	var produced []string
+	for path, after := range statAll(r.currentStep.ForbidOutputs) {
+		if after == nil {
+			continue
+		}
+		if r.batchOutputs.covers(path) {
+			continue
+		}
+		if prev := before[path]; prev == nil || !prev.ModTime().Equal(after.ModTime()) ||
+			prev.Size() != after.Size() {
+			produced = append(produced, path)
+		}
 	}
 
-	// Record that this step has been called one more time.
-	if i, ok := r.callCounts[name]; ok {
-		name = fmt.Sprintf("%s %d", name, i)
+	if len(produced) > 0 {
+		sort.Strings(produced)
+		err := fmt.Errorf("forbidden outputs were produced: %#v", produced)
+		return stepError("step produced forbidden outputs", err, r.currentStep, result)
 	}
-	r.callCounts[name]++
+	return nil
+}
 
-	// If there's a mock return value for the step, return it.  It's possible the user
-	// registered multiple mocks in their test; In this case, the first one registered
-	// wins because we search the list of mocks from 0...end.
-	var stepResult StepResult
-	for i, mock := range r.Mocks {
-		if mock.Step == name {
-			stepResult = mock.Result
-			// Prevent the mock from matching other steps by removing it.
-			r.Mocks = append(r.Mocks[:i], r.Mocks[i+1:]...)
-			break
-		}
+// Ensures the current step did not create or modify any files in the start directory
+// other than the given outputs, given the state of the start directory before the step
+// ran.  Returns an error otherwise.
+func (r *prodRunner) checkStartDir(before map[string]os.FileInfo, outputs []string, result StepResult) error {
+	after, err := statTree(r.startDir)
+	if err != nil {
+		return stepError("failed to snapshot start dir", err, r.currentStep, result)
 	}
 
-	r.stepLogs = append(r.stepLogs, stepLog{name, step, stepResult})
-	return stepResult
-}
+	var undeclared []string
+	for path, info := range after {
+		if prev := before[path]; prev != nil && prev.ModTime().Equal(info.ModTime()) &&
+			prev.Size() == info.Size() {
+			continue
+		}
+		if !isWithinAny(path, outputs) && !r.batchOutputs.covers(path) {
+			undeclared = append(undeclared, path)
+		}
+	}
 
-func (*testRunner) registerPlaceholder(content string) string {
-	return "[placeholder]"
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		err := fmt.Errorf("undeclared files were produced: %#v", undeclared)
+		return stepError("step modified the start dir", err, r.currentStep, result)
+	}
+	return nil
 }
 
-type recordingWriter struct {
-	Delegate io.Writer
-	buf      bytes.Buffer
+// Returns the file info for each file beneath root, by path.  Directories are omitted.
+func statTree(root string) (map[string]os.FileInfo, error) {
+	infos := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			infos[path] = info
+		}
+		return nil
+	})
+	return infos, err
 }
 
-func (w *recordingWriter) Write(b []byte) (int, error) {
-	if n, err := w.buf.Write(b); err != nil {
-		return n, err
+// Reports whether path is one of the given paths, or is inside one of them.
+func isWithinAny(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+			return true
+		}
 	}
-	return w.Delegate.Write(b)
+	return false
+}
+
+// Returns the paths matched by the given outputs, which may be glob patterns.
+func expandOutputs(outputs []string) []string {
+	var paths []string
+	for _, output := range outputs {
+		if !strings.ContainsAny(output, "*?[") {
+			paths = append(paths, output)
+			continue
+		}
+		matches, _ := filepath.Glob(output)
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// Returns the set of the given paths that exist, along with everything inside those that
+// are directories.
+func existingPaths(paths []string) map[string]bool {
+	existing := make(map[string]bool)
+	for _, root := range paths {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				existing[path] = true
+			}
+			return nil
+		})
+	}
+	return existing
+}
+
+// Removes each of the given paths, and everything inside those that are directories,
+// that is not in existing.  Paths in existing are never removed, so a directory that
+// existed before the step keeps its contents from before the step.
+func removeOutputs(existing map[string]bool, paths []string) error {
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if existing[path] {
+				return nil
+			}
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the file info for each of the given paths, or nil for paths that do not exist.
+func statAll(paths []string) map[string]os.FileInfo {
+	infos := make(map[string]os.FileInfo, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			info = nil
+		}
+		infos[path] = info
+	}
+	return infos
+}
+
+// Returns the timeout for the given step.
+func (r *prodRunner) timeout(step Step) time.Duration {
+	if step.Timeout > 0 {
+		return step.Timeout
+	}
+	return r.defaultTimeout
+}
+
+// Resolves the given binary name to an executable path.
+func (r *prodRunner) resolveBinary(file string) (string, error) {
+	if r.lookPath == nil {
+		return exec.LookPath(file)
+	}
+	return r.lookPath(file)
+}
+
+// Returns the absolute path of p, which may use the framework's path syntax.
+func (r *prodRunner) abs(p string) (string, error) {
+	if strings.HasPrefix(p, PathHome) {
+		if _, err := r.resolveHome(); err != nil {
+			return "", fmt.Errorf("failed to find home directory: %v", err)
+		}
+	}
+
+	paths := []string{p}
+	if err := r.convertAnyPaths(paths); err != nil {
+		return "", err
+	}
+	return filepath.Abs(paths[0])
+}
+
+// Returns the user's home directory.
+func (r *prodRunner) resolveHome() (string, error) {
+	if r.userHomeDir == nil {
+		return os.UserHomeDir()
+	}
+	return r.userHomeDir()
+}
+
+// Rename implements Runner
+func (r *prodRunner) Rename(name, oldPath, newPath string) {
+	r.currentStep = Step{
+		Command: []string{renameCommand, oldPath, newPath},
+		Outputs: []string{newPath},
+	}
+
+	if err := r.convertAnyPaths(r.currentStep.Command); err != nil {
+		logFatal("failed to convert paths in step command", err, r.currentStep)
+	}
+	if err := r.convertAnyPaths(r.currentStep.Outputs); err != nil {
+		logFatal("failed to convert paths in step outputs", err, r.currentStep)
+	}
+
+	if !r.recordOnly {
+		if err := os.Rename(r.currentStep.Command[1], r.currentStep.Command[2]); err != nil {
+			logFatal("failed to rename file", err, r.currentStep)
+		}
+	}
+
+	r.logStep(StepLog{StepName: name, Step: r.currentStep})
+}
+
+// RunAll implements Runner
+func (r *prodRunner) RunAll(prefix string, steps []Step) []StepResult {
+	return runAll(r, prefix, steps)
+}
+
+// RunParallel implements Runner
+//
+// Each step runs with a clone of r, since r tracks the step it is running.  The clones
+// share r's step log and run summary, and synchronize writes to r's stdout and stderr.
+// They also share the outputs of the batch, since a step cannot tell which files were
+// produced by its siblings.
+func (r *prodRunner) RunParallel(prefix string, steps []Step) []StepResult {
+	stdout, stderr := &syncWriter{w: r.stdout}, &syncWriter{w: r.stderr}
+	batch := &batchOutputs{}
+	results := make([]StepResult, len(steps))
+	runParallel(len(steps), r.parallelism, func(i int) {
+		clone := r.fork(stdout, stderr, batch)
+		results[i] = clone.Run(fmt.Sprintf("%s_%d", prefix, i), steps[i])
+	})
+	return results
+}
+
+// Returns a runner with r's configuration that runs a step concurrently with the others
+// in batch, writing to stdout and stderr.  Its step logs and summary entries are
+// recorded by r.
+func (r *prodRunner) fork(stdout, stderr io.Writer, batch *batchOutputs) *prodRunner {
+	return &prodRunner{
+		startDir:          r.startDir,
+		stdout:            stdout,
+		stderr:            stderr,
+		stepOutput:        r.stepOutput,
+		lookPath:          r.lookPath,
+		userHomeDir:       r.userHomeDir,
+		recordOnly:        r.recordOnly,
+		verbose:           r.verbose,
+		defaultTimeout:    r.defaultTimeout,
+		recordEnv:         r.recordEnv,
+		hashOutputs:       r.hashOutputs,
+		recordOutputModes: r.recordOutputModes,
+		recordOutputTimes: r.recordOutputTimes,
+		guardStartDir:     r.guardStartDir,
+		parallelism:       r.parallelism,
+		properties:        r.properties,
+		ctx:               r.ctx,
+		parent:            r,
+		batchOutputs:      batch,
+	}
+}
+
+// Returns the runner that records step logs and the run summary.
+func (r *prodRunner) root() *prodRunner {
+	if r.parent != nil {
+		return r.parent.root()
+	}
+	return r
+}
+
+// Applies fn to the run summary.  This is safe to call from concurrently running steps.
+func (r *prodRunner) updateSummary(fn func(*RunSummary)) {
+	root := r.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	fn(&root.summary)
+}
+
+// Phase implements Runner
+func (r *prodRunner) Phase(name string, fn func(Runner)) {
+	r.summary.runPhase(r, name, fn)
+}
+
+// Group implements Runner
+func (r *prodRunner) Group(name string) Runner {
+	return &groupRunner{Runner: r, prefix: name + "/"}
+}
+
+// Chdir implements Runner
+func (r *prodRunner) Chdir(path string) {
+	paths := []string{path}
+	if err := r.convertAnyPaths(paths); err != nil {
+		logFatal("failed to convert path", err, Step{})
+	}
+	if err := os.Chdir(paths[0]); err != nil {
+		logFatal("failed to change working directory", err, Step{})
+	}
+}
+
+// AssertExists implements Runner
+func (r *prodRunner) AssertExists(path string) {
+	step := Step{Command: []string{assertExistsCommand, path}}
+	if err := r.convertAnyPaths(step.Command); err != nil {
+		logFatal("failed to convert path", err, step)
+	}
+
+	if _, err := os.Stat(step.Command[1]); err != nil && !r.recordOnly {
+		logFatal("assertion failed", err, step)
+	}
+	r.logStep(StepLog{StepName: "assert_exists", Step: step})
+}
+
+// AssertExistsRelative implements Runner
+func (r *prodRunner) AssertExistsRelative(base, rel string) {
+	step := Step{Command: []string{assertExistsCommand, Join(base, rel)}}
+	if err := r.convertAnyPaths(step.Command); err != nil {
+		logFatal("failed to convert path", err, step)
+	}
+
+	if _, err := os.Stat(step.Command[1]); err != nil && !r.recordOnly {
+		logFatal("assertion failed", err, step)
+	}
+	r.logStep(StepLog{StepName: "assert_exists", Step: step})
+}
+
+// AssertOutputOrder implements Runner
+func (r *prodRunner) AssertOutputOrder(paths ...string) {
+	converted := append([]string(nil), paths...)
+	if err := r.convertAnyPaths(converted); err != nil {
+		logFatal("failed to convert paths", err, Step{})
+	}
+	if r.recordOnly {
+		return
+	}
+
+	var previous os.FileInfo
+	for i, path := range converted {
+		info, err := os.Stat(path)
+		if err != nil {
+			logFatal("assertion failed", err, Step{})
+		}
+		if previous != nil && info.ModTime().Before(previous.ModTime()) {
+			err := fmt.Errorf("%s was produced before %s", paths[i], paths[i-1])
+			logFatal("assertion failed", err, Step{})
+		}
+		previous = info
+	}
+}
+
+func (r *prodRunner) logStep(log StepLog) {
+	root := r.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if root.recordOnly {
+		root.recorded = append(root.recorded, log)
+	}
+
+	logWriter := root.logWriter
+	if logWriter == nil {
+		logWriter = NewJSONLogWriter(root.stepOutput)
+	}
+	if err := logWriter.Write(log); err != nil {
+		logFatal("failed to log step", err, r.currentStep)
+	}
+}
+
+// Writes the given step logs to the file at path.
+func writeRecord(path string, logs []StepLog) {
+	file, err := os.Create(path)
+	if err != nil {
+		logFatal("failed to create record file", err, Step{})
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(logs); err != nil {
+		logFatal("failed to write record file", err, Step{})
+	}
+}
+
+// Converts the input path to an absolute path for the current platform.
+func (r *prodRunner) convertAnyPaths(args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get cwd: %v", err)
+	}
+
+	roots := pathRoots{startDir: r.startDir, cwd: wd, placeholder: PlaceholderPath}
+	for i, p := range args {
+		if strings.HasPrefix(p, PathHome) && roots.home == "" {
+			home, err := r.resolveHome()
+			if err != nil {
+				logWarning(fmt.Sprintf("failed to find home directory for %q: %v", p, err), r.currentStep)
+				continue
+			}
+			roots.home = home
+		}
+		if converted, ok := roots.convert(p); ok {
+			args[i] = filepath.FromSlash(converted)
+		}
+	}
+	return nil
+}
+
+// A Runner that records step invocations for testing.
+//
+// This generates an "expectation", which is a serialized chain of step logs
+// representing the set of commands that would run in production.
+type testRunner struct {
+	Mocks      []Mock
+	callCounts map[string]int
+	stepLogs   []StepLog
+
+	// The set of paths declared as outputs by the steps run so far.
+	outputs map[string]bool
+
+	// The order in which paths were last declared, by path.
+	declared     map[string]int
+	declarations int
+
+	// The warnings issued so far.
+	warnings []string
+
+	// Whether to record each step's environment in its log.
+	recordEnv bool
+
+	// The spoofed platform, if any.
+	platform string
+
+	// Whether to record the digests of each step's outputs in its log.
+	hashOutputs bool
+
+	// Receives the log of each step as it is recorded, if set.
+	logWriter LogWriter
+
+	// The application's properties, as a JSON object.
+	properties string
+
+	// The result of steps that match no mock, if any.
+	defaultResult *StepResult
+
+	// Whether it is a fatal error for more than one mock to match a step.
+	strictMocks bool
+
+	// The stubbed environment of the process, against which step commands are expanded.
+	env map[string]string
+
+	// The virtual contents of files, by path, produced by mocked steps.
+	contents map[string][]byte
+
+	// Functions that undo the changes made to disk by mocked steps, in the order they
+	// were made.
+	undo []func() error
+
+	// The simulated working directory, relative to the start dir.  Empty if it is the
+	// start dir.
+	cwd string
+
+	summary RunSummary
+}
+
+// Run implements Runner
+//
+// This is called directly by the client's production code.
+func (r *testRunner) Run(name string, step Step) StepResult {
+	return r.RunWithStdin(name, step, nil)
+}
+
+// RunWithStdin implements Runner
+func (r *testRunner) RunWithStdin(name string, step Step, stdin io.Reader) StepResult {
+	result, err := r.run(name, step, stdin)
+	if err != nil {
+		r.warn(err.Error(), r.resolveStep(step))
+	}
+	return result
+}
+
+// TryRun implements Runner
+func (r *testRunner) TryRun(name string, step Step) (StepResult, error) {
+	return r.run(name, step, nil)
+}
+
+// Runs the mocked step, returning an error if it exited with a non-zero code and the
+// step sets FailOnNonZeroExit.
+func (r *testRunner) run(name string, step Step, stdin io.Reader) (StepResult, error) {
+	base := name
+	name = r.uniqueName(name)
+	original := step
+	step = r.resolveStep(step)
+
+	// If there's a mock return value for the step, return it.  It's possible the user
+	// registered multiple mocks in their test; In this case, the first one registered
+	// wins because we search the list of mocks from 0...end.  A mock is retired once it
+	// has been used as many times as it allows.
+	var stepResult StepResult
+	var matched bool
+	var created []string
+	var written map[string]string
+	var modes map[string]os.FileMode
+	for i, mock := range r.Mocks {
+		if mock.matches(name, base, original) {
+			if r.strictMocks {
+				r.checkAmbiguousMocks(i, name, base, original)
+			}
+			stepResult = mock.Result
+			matched = true
+			created = mock.Creates
+			written = mock.Contents
+			modes = mock.Modes
+			switch mock.Times {
+			case 0:
+				// The mock applies to every invocation.
+				r.Mocks[i].used = true
+			case 1:
+				r.Mocks = append(r.Mocks[:i], r.Mocks[i+1:]...)
+			default:
+				r.Mocks[i].Times--
+				r.Mocks[i].used = true
+			}
+			break
+		}
+	}
+	if !matched && r.defaultResult != nil {
+		stepResult = *r.defaultResult
+	}
+	if max := step.MaxOutputBytes; max > 0 {
+		stepResult.Stdout = truncateOutput(stepResult.Stdout, max)
+		stepResult.Stderr = truncateOutput(stepResult.Stderr, max)
+		stepResult.Combined = truncateOutput(stepResult.Combined, max)
+	}
+
+	log := StepLog{StepName: name, Step: step, StepResult: stepResult}
+	if r.recordEnv {
+		log.Env = redactEnv(mergeEnv(mergeEnv(nil, r.env), step.Env))
+	}
+	if step.Stdin != "" {
+		if stdin != nil {
+			logFatal("invalid step", errors.New("stdin given twice"), step)
+		}
+		var err error
+		if stdin, err = stepStdin(step); err != nil {
+			logFatal("failed to read step stdin", err, step)
+		}
+	}
+	if stdin != nil {
+		contents, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			logFatal("failed to read stdin", err, step)
+		}
+		log.Stdin = string(contents)
+	}
+
+	r.checkReads(step)
+
+	for path, content := range written {
+		r.write(path, []byte(content))
+	}
+	for path, content := range stepResult.Outputs {
+		r.write(path, []byte(content))
+		r.materialize(r.resolveCwd(path), []byte(content))
+	}
+	for path, mode := range modes {
+		if log.OutputModes == nil {
+			log.OutputModes = make(map[string]os.FileMode)
+		}
+		log.OutputModes[path] = mode
+		r.declare(path)
+	}
+	if r.hashOutputs {
+		log.OutputDigests = r.digests(step.Outputs)
+	}
+
+	r.record(log)
+	for _, path := range created {
+		r.declare(path)
+	}
+	r.summary.recordStep(name, stepResult)
+	r.summary.recordLogFiles(name, r.stepLogs[len(r.stepLogs)-1].Step.LogFiles)
+	if stepResult.ExitCode != 0 && step.FailOnNonZeroExit {
+		return stepResult, fmt.Errorf("step %q exited with code %d", name, stepResult.ExitCode)
+	}
+	return stepResult, nil
+}
+
+// Rename implements Runner
+//
+// No files are moved.  oldPath is removed from the set of declared outputs and newPath
+// is added to it.
+func (r *testRunner) Rename(name, oldPath, newPath string) {
+	oldPath, newPath = r.resolveCwd(oldPath), r.resolveCwd(newPath)
+	step := Step{
+		Command: []string{renameCommand, oldPath, newPath},
+		Outputs: []string{newPath},
+	}
+
+	if !r.exists(oldPath) {
+		r.warn(fmt.Sprintf("renaming undeclared path %q", oldPath), step)
+	}
+	delete(r.outputs, strings.TrimSuffix(oldPath, "/"))
+
+	r.record(StepLog{StepName: r.uniqueName(name), Step: step})
+}
+
+// RunAll implements Runner
+func (r *testRunner) RunAll(prefix string, steps []Step) []StepResult {
+	return runAll(r, prefix, steps)
+}
+
+// RunParallel implements Runner
+//
+// The steps are run one at a time, in order, so that the expectation is deterministic.
+func (r *testRunner) RunParallel(prefix string, steps []Step) []StepResult {
+	return runAll(r, prefix, steps)
+}
+
+// Phase implements Runner
+func (r *testRunner) Phase(name string, fn func(Runner)) {
+	r.summary.runPhase(r, name, fn)
+}
+
+// Fails if any remaining mock after the i'th also matches the named step.
+func (r *testRunner) checkAmbiguousMocks(i int, name, base string, step Step) {
+	for j := i + 1; j < len(r.Mocks); j++ {
+		if r.Mocks[j].matches(name, base, step) {
+			err := fmt.Errorf("step %q matches mocks for %s and %s", name,
+				r.Mocks[i].label(), r.Mocks[j].label())
+			logFatal("ambiguous mocks", err, step)
+		}
+	}
+}
+
+// Group implements Runner
+func (r *testRunner) Group(name string) Runner {
+	return &groupRunner{Runner: r, prefix: name + "/"}
+}
+
+// Chdir implements Runner
+//
+// The working directory is simulated, and is only used to resolve PathCwd paths.
+func (r *testRunner) Chdir(dir string) {
+	dir = r.resolveCwd(dir)
+	switch {
+	case strings.HasPrefix(dir, PathCwd):
+		r.cwd = strings.TrimPrefix(dir, PathCwd)
+	case strings.HasPrefix(dir, PathPlaceholder):
+		r.warn(fmt.Sprintf("cannot simulate changing directory to %q", dir), Step{})
+		return
+	case strings.HasPrefix(dir, StartDir):
+		r.cwd = strings.TrimPrefix(dir, StartDir)
+	case !strings.HasPrefix(dir, "/"):
+		r.cwd = path.Join(r.cwd, dir)
+	default:
+		r.warn(fmt.Sprintf("cannot simulate changing directory to %q", dir), Step{})
+		return
+	}
+
+	r.cwd = path.Clean(r.cwd)
+	if r.cwd == "." {
+		r.cwd = ""
+	}
+}
+
+// Returns the absolute path of p, which may use the framework's path syntax, against the
+// simulated roots.
+func (r *testRunner) abs(p string) string {
+	roots := simulatedRoots(r.cwd)
+	if converted, ok := roots.convert(p); ok {
+		return converted
+	}
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(roots.cwd, p)
+}
+
+// Rewrites a path rooted at the current working directory to be rooted at the start
+// dir, if the simulated working directory is not the start dir.  Other paths are
+// returned unchanged.
+func (r *testRunner) resolveCwd(p string) string {
+	if r.cwd == "" || !strings.HasPrefix(p, PathCwd) {
+		return p
+	}
+
+	resolved := StartDir + path.Join(r.cwd, strings.TrimPrefix(p, PathCwd))
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(resolved, "/") {
+		resolved += "/"
+	}
+	return resolved
+}
+
+// Returns a copy of step with environment variables in its command expanded, if
+// requested, and paths rooted at the current working directory resolved.
+func (r *testRunner) resolveStep(step Step) Step {
+	if step.ExpandEnv {
+		step.Command = expandEnv(step.Command, mergeEnv(mergeEnv(nil, r.env), step.Env))
+	}
+	if r.cwd == "" {
+		return step
+	}
+	return mapStepPaths(step, r.resolveCwd)
+}
+
+// ListDir implements Runner
+func (r *prodRunner) ListDir(path string) []string {
+	paths := []string{path}
+	if err := r.convertAnyPaths(paths); err != nil {
+		logFatal("failed to convert path", err, Step{})
+	}
+
+	infos, err := ioutil.ReadDir(paths[0])
+	if err != nil {
+		logFatal("failed to list directory", err, Step{})
+	}
+
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// Stat implements Runner
+func (r *prodRunner) Stat(path string) (FileInfoLite, bool) {
+	paths := []string{path}
+	if err := r.convertAnyPaths(paths); err != nil {
+		logFatal("failed to convert path", err, Step{})
+	}
+
+	info, err := os.Stat(paths[0])
+	if os.IsNotExist(err) {
+		return FileInfoLite{}, false
+	}
+	if err != nil {
+		logFatal("failed to stat file", err, Step{})
+	}
+	return FileInfoLite{
+		Name:  info.Name(),
+		Size:  info.Size(),
+		Mode:  info.Mode(),
+		IsDir: info.IsDir(),
+	}, true
+}
+
+// ReadFile implements Runner
+func (r *prodRunner) ReadFile(path string) ([]byte, error) {
+	paths := []string{path}
+	if err := r.convertAnyPaths(paths); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(paths[0])
+}
+
+// WriteFile implements Runner
+func (r *prodRunner) WriteFile(path string, data []byte) {
+	step := Step{
+		Command: []string{writeFileCommand, path},
+		Outputs: []string{path},
+	}
+	if isAbsolutePath(path) {
+		logWarning(fmt.Sprintf("writing to absolute path %q", path), step)
+	}
+
+	if err := r.convertAnyPaths(step.Command); err != nil {
+		logFatal("failed to convert paths in step command", err, step)
+	}
+	if err := r.convertAnyPaths(step.Outputs); err != nil {
+		logFatal("failed to convert paths in step outputs", err, step)
+	}
+
+	if !r.recordOnly {
+		if err := ioutil.WriteFile(step.Command[1], data, 0644); err != nil {
+			logFatal("failed to write file", err, step)
+		}
+	}
+	r.logStep(StepLog{StepName: "write_file", Step: step})
+}
+
+// PlaceholderContents implements Runner
+func (r *prodRunner) PlaceholderContents(ref string) []byte {
+	return readPlaceholder(ref)
+}
+
+// Platform implements Runner
+func (r *prodRunner) Platform() string {
+	return runtime.GOOS
+}
+
+// Properties implements Runner
+func (r *prodRunner) Properties(dst interface{}) {
+	unmarshalProperties(r.properties, dst)
+}
+
+// Warns about each path in step's command that was not declared as an output of a
+// previous step, since production may not be able to read it.  The step's own outputs
+// are ignored.
+func (r *testRunner) checkReads(step Step) {
+	for _, arg := range step.Command {
+		if !isFrameworkPath(arg) || r.covers(arg) || isOutputOf(arg, step) {
+			continue
+		}
+		r.warn(fmt.Sprintf("reading undeclared path %q", arg), step)
+	}
+}
+
+// Reports whether path exists, or is inside a path declared as an output of a previous
+// step.
+func (r *testRunner) covers(path string) bool {
+	if r.exists(path) {
+		return true
+	}
+	for output := range r.outputs {
+		if strings.HasPrefix(path, output+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether path is one of step's outputs, or is inside one of them.
+func isOutputOf(path string, step Step) bool {
+	for _, output := range step.Outputs {
+		output = strings.TrimSuffix(output, "/")
+		if path == output || strings.HasPrefix(path, output+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AssertOutputOrder implements Runner
+func (r *testRunner) AssertOutputOrder(paths ...string) {
+	for i, path := range paths {
+		path = r.resolveCwd(path)
+		if !r.exists(path) {
+			r.warn(fmt.Sprintf("asserting order of undeclared path %q", path), Step{})
+			continue
+		}
+		if i == 0 {
+			continue
+		}
+		previous := strings.TrimSuffix(r.resolveCwd(paths[i-1]), "/")
+		if r.declared[strings.TrimSuffix(path, "/")] < r.declared[previous] {
+			r.warn(fmt.Sprintf("%q was declared before %q", path, previous), Step{})
+		}
+	}
+}
+
+// AssertExists implements Runner
+func (r *testRunner) AssertExists(path string) {
+	path = r.resolveCwd(path)
+	step := Step{Command: []string{assertExistsCommand, path}}
+	if !r.exists(path) {
+		r.warn(fmt.Sprintf("asserting existence of undeclared path %q", path), step)
+	}
+	r.record(StepLog{StepName: r.uniqueName("assert_exists"), Step: step})
+}
+
+// AssertExistsRelative implements Runner
+func (r *testRunner) AssertExistsRelative(base, rel string) {
+	path := r.resolveCwd(Join(base, rel))
+	step := Step{Command: []string{assertExistsCommand, path}}
+	if !r.exists(path) {
+		r.warn(fmt.Sprintf("asserting existence of undeclared path %q", path), step)
+	}
+	r.record(StepLog{StepName: r.uniqueName("assert_exists"), Step: step})
+}
+
+// Issues a warning and records it so tests can assert on it.
+func (r *testRunner) warn(message string, step Step) {
+	r.warnings = append(r.warnings, message)
+	logWarning(message, step)
+}
+
+// PlaceholderContents implements Runner
+func (r *testRunner) PlaceholderContents(ref string) []byte {
+	if contents, ok := r.contents[PathPlaceholder+placeholderID(ref)]; ok {
+		return contents
+	}
+	return readPlaceholder(ref)
+}
+
+// Platform implements Runner
+func (r *testRunner) Platform() string {
+	if r.platform != "" {
+		return r.platform
+	}
+	return runtime.GOOS
+}
+
+// Properties implements Runner
+func (r *testRunner) Properties(dst interface{}) {
+	unmarshalProperties(r.properties, dst)
+}
+
+// Unmarshals the JSON object properties into dst, which is left unchanged if properties
+// is empty.  Fails if any property does not match a field of dst.
+func unmarshalProperties(properties string, dst interface{}) {
+	if properties == "" {
+		return
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(properties))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		logFatal("failed to read properties", err, Step{})
+	}
+}
+
+// Stat implements Runner
+func (r *testRunner) Stat(p string) (FileInfoLite, bool) {
+	p = strings.TrimSuffix(r.resolveCwd(p), "/")
+	if !r.exists(p) {
+		return FileInfoLite{}, false
+	}
+
+	info := FileInfoLite{Name: path.Base(p), Size: int64(len(r.contents[p]))}
+	for output := range r.outputs {
+		if strings.HasPrefix(output, p+"/") {
+			info.IsDir = true
+			break
+		}
+	}
+	return info, true
+}
+
+// ReadFile implements Runner
+func (r *testRunner) ReadFile(p string) ([]byte, error) {
+	p = r.resolveCwd(p)
+	if contents, ok := r.contents[p]; ok {
+		return contents, nil
+	}
+	if strings.HasPrefix(p, PathPlaceholder) {
+		return ReadPlaceholderBytes(p)
+	}
+	return nil, fmt.Errorf("no contents were given for %q by a mock", p)
+}
+
+// WriteFile implements Runner
+func (r *testRunner) WriteFile(p string, data []byte) {
+	p = r.resolveCwd(p)
+	step := Step{
+		Command: []string{writeFileCommand, p},
+		Outputs: []string{p},
+	}
+	if isAbsolutePath(p) {
+		r.warn(fmt.Sprintf("writing to absolute path %q", p), step)
+	}
+
+	r.write(p, data)
+	r.record(StepLog{StepName: r.uniqueName("write_file"), Step: step})
+}
+
+// ListDir implements Runner
+func (r *testRunner) ListDir(path string) []string {
+	prefix := strings.TrimSuffix(r.resolveCwd(path), "/") + "/"
+	seen := make(map[string]bool)
+	var names []string
+	for output := range r.outputs {
+		if !strings.HasPrefix(output, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(output, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns name, suffixed with the number of times a step with the same name has
+// already run.
+func (r *testRunner) uniqueName(name string) string {
+	if r.callCounts == nil {
+		r.callCounts = make(map[string]int)
+	}
+
+	// Record that this step has been called one more time.
+	i := r.callCounts[name]
+	r.callCounts[name]++
+	if i > 0 {
+		name = fmt.Sprintf("%s %d", name, i)
+	}
+	return name
+}
+
+// Appends the given log to the expectation and, if the step succeeded, declares the
+// step's outputs.
+func (r *testRunner) record(log StepLog) {
+	if log.StepResult.ExitCode == 0 {
+		for _, output := range log.Step.Outputs {
+			r.declare(output)
+		}
+	}
+	log = r.convertLog(log)
+	r.stepLogs = append(r.stepLogs, log)
+	if r.logWriter != nil {
+		if err := r.logWriter.Write(log); err != nil {
+			logFatal("failed to log step", err, log.Step)
+		}
+	}
+}
+
+// Returns a copy of log with its paths resolved against the simulated roots, so that
+// expectations are portable across machines.
+func (r *testRunner) convertLog(log StepLog) StepLog {
+	roots := simulatedRoots(r.cwd)
+	convert := func(p string) string {
+		converted, _ := roots.convert(p)
+		return converted
+	}
+
+	log.Step = mapStepPaths(log.Step, convert)
+	if log.StepResult.Outputs != nil {
+		outputs := make(map[string]string, len(log.StepResult.Outputs))
+		for p, output := range log.StepResult.Outputs {
+			outputs[convert(p)] = output
+		}
+		log.StepResult.Outputs = outputs
+	}
+	if log.OutputDigests != nil {
+		digests := make(map[string]string, len(log.OutputDigests))
+		for p, digest := range log.OutputDigests {
+			digests[convert(p)] = digest
+		}
+		log.OutputDigests = digests
+	}
+	if log.OutputModes != nil {
+		modes := make(map[string]os.FileMode, len(log.OutputModes))
+		for p, mode := range log.OutputModes {
+			modes[convert(p)] = mode
+		}
+		log.OutputModes = modes
+	}
+	return log
+}
+
+// Marks path as existing.  A trailing "/" is ignored.
+func (r *testRunner) declare(path string) {
+	if r.outputs == nil {
+		r.outputs = make(map[string]bool)
+	}
+	r.outputs[strings.TrimSuffix(path, "/")] = true
+
+	if r.declared == nil {
+		r.declared = make(map[string]int)
+	}
+	r.declarations++
+	r.declared[strings.TrimSuffix(path, "/")] = r.declarations
+}
+
+// Sets the virtual contents of path, and marks it as existing.
+func (r *testRunner) write(path string, contents []byte) {
+	if r.contents == nil {
+		r.contents = make(map[string][]byte)
+	}
+	r.contents[path] = contents
+	r.declare(path)
+}
+
+// Writes contents to the file at the framework path p on disk, so that the recipe may
+// read it.  The start dir and current working directory are the process's working
+// directory.  The change is undone by cleanup.
+//
+// Only placeholders and paths within the working directory are written, so that tests
+// never modify files elsewhere, such as in the user's home directory.  Other paths are
+// left to the virtual filesystem.
+func (r *testRunner) materialize(p string, contents []byte) {
+	if strings.HasPrefix(p, PathHome) {
+		return
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		logFatal("failed to get cwd", err, Step{})
+	}
+	isPlaceholder := strings.HasPrefix(p, PathPlaceholder)
+	roots := pathRoots{startDir: wd, cwd: wd, placeholder: PlaceholderPath}
+	if converted, ok := roots.convert(p); ok {
+		p = filepath.FromSlash(converted)
+	}
+	if abs, err := filepath.Abs(p); err != nil || !isPlaceholder && !isWithinAny(abs, []string{wd}) {
+		return
+	}
+
+	if info, err := os.Stat(p); err == nil {
+		original, err := ioutil.ReadFile(p)
+		if err != nil {
+			logFatal("failed to read mocked output", err, Step{})
+		}
+		r.undo = append(r.undo, func() error {
+			return ioutil.WriteFile(p, original, info.Mode())
+		})
+	} else {
+		// Remove the outermost directory created for the file, if any.
+		created := p
+		for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+			if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+				break
+			}
+			created = dir
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			logFatal("failed to create mocked output", err, Step{})
+		}
+		r.undo = append(r.undo, func() error { return os.RemoveAll(created) })
+	}
+
+	if err := ioutil.WriteFile(p, contents, 0644); err != nil {
+		logFatal("failed to write mocked output", err, Step{})
+	}
+}
+
+// Undoes the changes made to disk by mocked steps, most recent first.
+func (r *testRunner) cleanup() error {
+	var failed []string
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	r.undo = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to clean up mocked outputs: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Returns the digests of the virtual contents of the given paths, by path.  Paths
+// without virtual contents are skipped.
+func (r *testRunner) digests(paths []string) map[string]string {
+	digests := make(map[string]string)
+	for _, path := range paths {
+		if contents, ok := r.contents[path]; ok {
+			digests[path] = digest(contents)
+		}
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+	return digests
+}
+
+// Reports whether path is a placeholder, was declared as an output of a previous step,
+// or is a directory containing such an output.
+func (r *testRunner) exists(path string) bool {
+	if strings.HasPrefix(path, PathPlaceholder) {
+		return true
+	}
+
+	path = strings.TrimSuffix(path, "/")
+	if r.outputs[path] {
+		return true
+	}
+	for output := range r.outputs {
+		if strings.HasPrefix(output, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (*testRunner) registerPlaceholder(content string) string {
+	return "[placeholder]"
+}
+
+// Returns a reader for the given step's Stdin, which may be a placeholder.
+func stepStdin(step Step) (io.Reader, error) {
+	if !strings.HasPrefix(step.Stdin, PathPlaceholder) {
+		return strings.NewReader(step.Stdin), nil
+	}
+
+	id := strings.TrimPrefix(step.Stdin, PathPlaceholder)
+	contents, err := ioutil.ReadFile(PlaceholderPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(contents), nil
+}
+
+// Returns the path of the backing file or directory of the placeholder with the given
+// ID, or an error if there is no such placeholder.
+func lookupPlaceholder(id string) (string, error) {
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+
+	path, ok := placeholders[id]
+	if !ok {
+		return "", fmt.Errorf("unknown placeholder ID: %v", id)
+	}
+	return path, nil
+}
+
+// Returns the ID of the placeholder ref, which may be a placeholder or an ID.
+func placeholderID(ref string) string {
+	return strings.TrimPrefix(ref, PathPlaceholder)
+}
+
+// Returns the contents of the backing file of the placeholder ref.  Fails if the file
+// cannot be read.
+func readPlaceholder(ref string) []byte {
+	contents, err := ioutil.ReadFile(PlaceholderPath(placeholderID(ref)))
+	if err != nil {
+		logFatal("failed to read placeholder", err, Step{})
+	}
+	return contents
+}
+
+// Removes the backing files and directories of the placeholders created since count
+// placeholders had been, and forgets them, so that their IDs are reused.
+func rollBackPlaceholders(count int64) {
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+
+	for id, path := range placeholders {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && n >= count {
+			os.RemoveAll(path)
+			delete(placeholders, id)
+		}
+	}
+	atomic.StoreInt64(&placeholderCount, count)
+}
+
+// Runs steps in order with r, naming them after prefix and their indices.
+func runAll(r Runner, prefix string, steps []Step) []StepResult {
+	results := make([]StepResult, len(steps))
+	for i, step := range steps {
+		results[i] = r.Run(fmt.Sprintf("%s_%d", prefix, i), step)
+	}
+	return results
+}
+
+// Calls fn with each index in [0, n) from a pool of at most limit goroutines, and waits
+// for the calls to return.  If limit is zero, every call gets its own goroutine.  If any
+// call panics, for example with a fatal error, the first such panic is repeated in the
+// calling goroutine.
+func runParallel(n, limit int, fn func(i int)) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failure interface{}
+
+	workers := limit
+	if workers <= 0 || workers > n {
+		workers = n
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				func() {
+					defer func() {
+						if v := recover(); v != nil {
+							once.Do(func() { failure = v })
+						}
+					}()
+					fn(i)
+				}()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// A Runner that prefixes the names of all steps it runs before delegating to another
+// Runner.
+type groupRunner struct {
+	Runner
+	prefix string
+}
+
+// Run implements Runner
+func (r *groupRunner) Run(name string, step Step) StepResult {
+	return r.Runner.Run(r.prefix+name, step)
+}
+
+// RunWithStdin implements Runner
+func (r *groupRunner) RunWithStdin(name string, step Step, stdin io.Reader) StepResult {
+	return r.Runner.RunWithStdin(r.prefix+name, step, stdin)
+}
+
+// TryRun implements Runner
+func (r *groupRunner) TryRun(name string, step Step) (StepResult, error) {
+	return r.Runner.TryRun(r.prefix+name, step)
+}
+
+// Rename implements Runner
+func (r *groupRunner) Rename(name, oldPath, newPath string) {
+	r.Runner.Rename(r.prefix+name, oldPath, newPath)
+}
+
+// RunAll implements Runner
+func (r *groupRunner) RunAll(prefix string, steps []Step) []StepResult {
+	return r.Runner.RunAll(r.prefix+prefix, steps)
+}
+
+// RunParallel implements Runner
+func (r *groupRunner) RunParallel(prefix string, steps []Step) []StepResult {
+	return r.Runner.RunParallel(r.prefix+prefix, steps)
+}
+
+// Phase implements Runner
+func (r *groupRunner) Phase(name string, fn func(Runner)) {
+	r.Runner.Phase(r.prefix+name, fn)
+}
+
+// Group implements Runner
+func (r *groupRunner) Group(name string) Runner {
+	return &groupRunner{Runner: r.Runner, prefix: r.prefix + name + "/"}
+}
+
+// The outputs declared by the steps of a RunParallel batch, which may be glob patterns.
+// A nil *batchOutputs holds no outputs.
+type batchOutputs struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// Adds the outputs of a step in the batch.
+func (b *batchOutputs) add(paths []string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paths = append(b.paths, paths...)
+}
+
+// Reports whether path is one of the outputs, or is beneath one.
+func (b *batchOutputs) covers(path string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		for _, output := range b.paths {
+			if matched, _ := filepath.Match(output, path); matched {
+				return true
+			}
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// An io.Writer that serializes writes to w, so that it may be shared by concurrently
+// running steps.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// An io.Writer that records everything written to it, and streams it to Delegate.
+// If Limit is positive, only the last Limit bytes written are recorded.  Otherwise, if
+// Max is positive, only the first Max bytes are recorded, followed by a marker giving
+// the number of bytes dropped.
+//
+// Streaming is best-effort: if Delegate fails, a warning is issued and nothing more is
+// written to it, but recording continues.
+type recordingWriter struct {
+	Delegate io.Writer
+	Limit    int
+	Max      int
+	buf      bytes.Buffer
+	dropped  int
+
+	delegateFailed bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	record := b
+	if w.Limit <= 0 && w.Max > 0 {
+		if room := w.Max - w.buf.Len(); len(record) > room {
+			w.dropped += len(record) - room
+			record = record[:room]
+		}
+	}
+	if n, err := w.buf.Write(record); err != nil {
+		return n, err
+	}
+	if w.Limit > 0 && w.buf.Len() > w.Limit {
+		w.buf.Next(w.buf.Len() - w.Limit)
+	}
+
+	if !w.delegateFailed {
+		if _, err := w.Delegate.Write(b); err != nil {
+			w.delegateFailed = true
+			logWarning(fmt.Sprintf("failed to stream step output: %v", err), Step{})
+		}
+	}
+	return len(b), nil
 }
 
 func (w *recordingWriter) String() string {
+	if w.dropped > 0 {
+		return w.buf.String() + truncationMarker(w.dropped)
+	}
 	return w.buf.String()
 }
+
+// Returns s, truncated to its first max bytes followed by a marker giving the number of
+// bytes dropped, if it is longer than max.
+func truncateOutput(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + truncationMarker(len(s)-max)
+}
+
+// Returns the marker appended to output from which n bytes were dropped.
+func truncationMarker(n int) string {
+	return fmt.Sprintf("...[truncated %d bytes]", n)
+}
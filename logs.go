@@ -0,0 +1,63 @@
+package chow
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// LogWriter receives the log of each step as the step finishes.
+//
+// In production, step logs are written as JSON to MainOptions.StepLog, unless
+// MainOptions.LogWriter is set.  In tests, step logs are also written to
+// TestCase.LogWriter, if set, as they would appear in the expectation.
+type LogWriter interface {
+	Write(log StepLog) error
+}
+
+// NewJSONLogWriter returns a LogWriter that writes each step log to w as indented JSON.
+func NewJSONLogWriter(w io.Writer) LogWriter {
+	return &jsonLogWriter{w: w}
+}
+
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (w *jsonLogWriter) Write(log StepLog) error {
+	encoder := json.NewEncoder(w.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(log)
+}
+
+// StreamLogger is a LogWriter that writes a compact StreamRecord for each step to an
+// io.Writer, as line-delimited JSON.  This suits streaming ingestion by log services,
+// where the full step log would be too large.
+//
+// Use it in production by setting MainOptions.LogWriter.
+type StreamLogger struct {
+	w io.Writer
+}
+
+// NewStreamLogger returns a StreamLogger that writes to w.
+func NewStreamLogger(w io.Writer) *StreamLogger {
+	return &StreamLogger{w: w}
+}
+
+// StreamRecord is the record of a single step written by StreamLogger.
+type StreamRecord struct {
+	StepName string        `json:"step_name"`
+	Command  []string      `json:"command"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Write implements LogWriter
+func (l *StreamLogger) Write(log StepLog) error {
+	return json.NewEncoder(l.w).Encode(StreamRecord{
+		StepName: log.StepName,
+		Command:  log.Step.Command,
+		ExitCode: log.StepResult.ExitCode,
+		Duration: log.StepResult.Duration,
+	})
+}
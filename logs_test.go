@@ -0,0 +1,52 @@
+package chow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreamLogger(t *testing.T) {
+	t.Run("should write one line per step", func(t *testing.T) {
+		var b bytes.Buffer
+		logger := NewStreamLogger(&b)
+		logs := []StepLog{
+			{
+				StepName:   "build",
+				Step:       Step{Command: []string{"make"}, Env: map[string]string{"CC": "clang"}},
+				StepResult: StepResult{Stdout: "lots of output", Duration: time.Second},
+			},
+			{
+				StepName:   "test",
+				Step:       Step{Command: []string{"make", "test"}},
+				StepResult: StepResult{ExitCode: 2},
+			},
+		}
+		for _, log := range logs {
+			if err := logger.Write(log); err != nil {
+				t.Fatalf("expected no error. Got %v", err)
+			}
+		}
+
+		var records []StreamRecord
+		scanner := bufio.NewScanner(&b)
+		for scanner.Scan() {
+			var record StreamRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("failed to decode line %q: %v", scanner.Text(), err)
+			}
+			records = append(records, record)
+		}
+
+		expected := []StreamRecord{
+			{StepName: "build", Command: []string{"make"}, Duration: time.Second},
+			{StepName: "test", Command: []string{"make", "test"}, ExitCode: 2},
+		}
+		if !reflect.DeepEqual(expected, records) {
+			t.Errorf("expected %+v. Got %+v", expected, records)
+		}
+	})
+}
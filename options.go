@@ -0,0 +1,86 @@
+package chow
+
+import (
+	"context"
+	"flag"
+	"io"
+	"runtime"
+	"time"
+)
+
+// options configures the framework in production.  These are set from command-line
+// flags registered alongside the application's own flags.
+type options struct {
+	// Where step logs are written.  Defaults to the console's stdout.
+	stepLog io.Writer
+
+	// Receives step logs instead of stepLog, if set.
+	logWriter LogWriter
+
+	// If set, steps are not run.  Instead, their logs are written to this file.
+	recordPath string
+
+	// If true, steps are logged but not run.
+	dryRun bool
+
+	// If true, each step's resolved command is printed to stderr before it runs.
+	verbose bool
+
+	// The timeout for steps that do not specify one.  Zero means no timeout.
+	timeout time.Duration
+
+	// Whether to record each step's environment in its log.
+	recordEnv bool
+
+	// Whether to record the digests of each step's outputs in its log.
+	hashOutputs bool
+
+	// Whether to record the modes of each step's outputs in its log.
+	recordOutputModes bool
+
+	// Whether to record the modification times of each step's outputs in its log.
+	recordOutputTimes bool
+
+	// Whether to fail steps that modify the start directory outside their outputs.
+	guardStartDir bool
+
+	// The maximum number of steps run at once by Runner.RunParallel.  Zero means no limit.
+	parallelism int
+
+	// The application's properties, as a JSON object.
+	properties string
+
+	// If set, the run summary is written to this file as JSON after the run.
+	summaryPath string
+
+	// Cancels the run when done.  Defaults to context.Background().
+	ctx context.Context
+}
+
+// Registers the framework's flags on f.  All framework flags are prefixed with "chow.".
+func (o *options) register(f *flag.FlagSet) {
+	f.StringVar(&o.recordPath, "chow.record", "",
+		"Write the steps that would run to this file, without running them")
+	f.BoolVar(&o.dryRun, "chow.dryrun", false,
+		"Log the steps that would run, with their paths resolved, without running them")
+	f.BoolVar(&o.verbose, "chow.verbose", false,
+		"Print each step's name and resolved command to stderr before running it")
+	f.DurationVar(&o.timeout, "chow.timeout", 0,
+		"The default timeout for steps that do not specify one")
+	f.BoolVar(&o.recordEnv, "chow.record_env", false,
+		"Record the environment of each step in its log, with secrets redacted")
+	f.BoolVar(&o.hashOutputs, "chow.hash_outputs", false,
+		"Record the sha256 digest of each step's outputs in its log")
+	f.BoolVar(&o.recordOutputModes, "chow.record_output_modes", false,
+		"Record the mode of each step's outputs in its log")
+	f.BoolVar(&o.recordOutputTimes, "chow.record_output_times", false,
+		"Record the modification time of each step's outputs in its log")
+	f.BoolVar(&o.guardStartDir, "chow.guard_start_dir", false,
+		"Fail if a step creates or modifies files in the start directory that are not outputs")
+	f.IntVar(&o.parallelism, "chow.parallelism", runtime.NumCPU(),
+		"The maximum number of steps to run at once in parallel, or 0 for no limit")
+	f.StringVar(&o.properties, "chow.properties", "",
+		"The application's properties, as a JSON object")
+	f.StringVar(&o.summaryPath, "chow.summary", "",
+		"Write a summary of the run to this file as JSON, even if the run fails")
+}
@@ -0,0 +1,203 @@
+package chow
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Prefixes of the paths understood by the framework.
+//
+// These may be used in a step's command, outputs, directory and environment, and in the
+// paths given to Runner methods.  They are resolved to absolute paths for the current
+// platform before steps run.  Since StartDir is a prefix of the others, prefixes are
+// matched longest-first.  Paths should always use "/" as a separator.
+const (
+	// StartDir is the directory the application was started in, e.g. "//out/a.txt".
+	StartDir = "//"
+
+	// PathCwd is the current working directory, e.g. "//CWD/a.txt".
+	PathCwd = "//CWD/"
+
+	// PathPlaceholder is followed by the ID of a placeholder.  See Placeholder.
+	PathPlaceholder = "//ph/"
+
+	// PathHome is the user's home directory, e.g. "//HOME/.config".  A warning is
+	// issued if the home directory cannot be determined, and the path is left as is.
+	PathHome = "//HOME/"
+)
+
+// The framework's path prefixes, longest first.
+var pathPrefixes = []string{PathHome, PathCwd, PathPlaceholder, StartDir}
+
+// Reports whether p is an absolute path on the current machine, rather than a
+// framework path.
+func isAbsolutePath(p string) bool {
+	return !isFrameworkPath(p) && (filepath.IsAbs(p) || strings.HasPrefix(p, "/"))
+}
+
+// Reports whether p begins with one of the framework's path prefixes.
+func isFrameworkPath(p string) bool {
+	for _, prefix := range pathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Join joins any number of path elements onto root, which may begin with one of the
+// framework's path prefixes, such as StartDir or PathCwd.
+//
+// The prefix is preserved, and the remaining elements are joined with "/" and cleaned,
+// so that duplicate slashes are collapsed.  The result always uses "/" as a separator,
+// and is converted for the current platform when used in a step.
+func Join(root string, elems ...string) string {
+	prefix := ""
+	for _, p := range pathPrefixes {
+		if strings.HasPrefix(root, p) {
+			prefix, root = p, strings.TrimPrefix(root, p)
+			break
+		}
+	}
+
+	joined := path.Join(append([]string{root}, elems...)...)
+	if prefix == "" {
+		return joined
+	}
+	return prefix + strings.TrimPrefix(joined, "/")
+}
+
+// Abs resolves p, which may use the framework's path syntax, to an absolute path.
+//
+// This allows applications to use paths outside of step commands, for example to read a
+// file with ioutil.ReadFile.  Relative paths are resolved against the current working
+// directory.  While an application runs in a test, paths are resolved against the same
+// simulated roots as paths in step logs.  Outside of Main, the start dir is the current
+// working directory.
+func Abs(p string) (string, error) {
+	switch r := activeRunner.(type) {
+	case *testRunner:
+		return r.abs(p), nil
+	case *prodRunner:
+		return r.abs(p)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get cwd: %v", err)
+	}
+	return (&prodRunner{startDir: wd}).abs(p)
+}
+
+// The runner of the application that is currently running, if any.
+var activeRunner Runner
+
+// Sets the runner of the application that is currently running, and returns a function
+// that restores the previous one.
+func setActiveRunner(r Runner) func() {
+	previous := activeRunner
+	activeRunner = r
+	return func() {
+		activeRunner = previous
+	}
+}
+
+// simulatedStartDir is the start dir against which paths are resolved in tests, so that
+// expectations do not depend on the machine they were generated on.
+const simulatedStartDir = "[START_DIR]"
+
+// simulatedPlaceholderDir is the directory that placeholders are resolved to in tests.
+const simulatedPlaceholderDir = "[PLACEHOLDER]"
+
+// simulatedHome is the home directory against which paths are resolved in tests.
+const simulatedHome = "[HOME]"
+
+// The roots against which framework paths are resolved.
+type pathRoots struct {
+	startDir string
+	cwd      string
+	home     string
+
+	// Returns the path of the placeholder with the given ID.
+	placeholder func(id string) string
+}
+
+// Returns the roots used to resolve paths in tests, given the simulated working
+// directory relative to the start dir.
+func simulatedRoots(cwd string) pathRoots {
+	return pathRoots{
+		startDir: simulatedStartDir,
+		cwd:      path.Join(simulatedStartDir, cwd),
+		home:     simulatedHome,
+		placeholder: func(id string) string {
+			return simulatedPlaceholderDir + "/" + id
+		},
+	}
+}
+
+// Returns the framework path p resolved as it would be in a test's step logs, given
+// that the working directory is the start dir.
+func simulatedPath(p string) string {
+	converted, _ := simulatedRoots("").convert(p)
+	return converted
+}
+
+// Resolves the framework path p against these roots, joining path elements with "/".
+// Reports false if p is not a framework path, such as an absolute path, a relative path
+// or a non-path argument, in which case it is returned unchanged.
+func (roots pathRoots) convert(p string) (string, bool) {
+	// Match the longest prefixes first.
+	switch {
+	case strings.HasPrefix(p, PathHome):
+		return strings.TrimRight(roots.home, "/") + "/" + strings.TrimPrefix(p, PathHome), true
+	case strings.HasPrefix(p, PathCwd):
+		return strings.TrimRight(roots.cwd, "/") + "/" + strings.TrimPrefix(p, PathCwd), true
+	case strings.HasPrefix(p, PathPlaceholder):
+		// Paths inside directory placeholders are resolved against the directory.
+		parts := strings.SplitN(strings.TrimPrefix(p, PathPlaceholder), "/", 2)
+		if len(parts) == 2 {
+			return roots.placeholder(parts[0]) + "/" + parts[1], true
+		}
+		return roots.placeholder(parts[0]), true
+	case strings.HasPrefix(p, StartDir):
+		return strings.TrimRight(roots.startDir, "/") + "/" + strings.TrimPrefix(p, StartDir), true
+	}
+	return p, false
+}
+
+// Returns a copy of step with fn applied to each of its paths.
+func mapStepPaths(step Step, fn func(string) string) Step {
+	mapAll := func(paths []string) []string {
+		if paths == nil {
+			return nil
+		}
+		mapped := make([]string, len(paths))
+		for i, p := range paths {
+			mapped[i] = fn(p)
+		}
+		return mapped
+	}
+
+	mapAllValues := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		mapped := make(map[string]string, len(m))
+		for key, p := range m {
+			mapped[key] = fn(p)
+		}
+		return mapped
+	}
+
+	step.Command = mapAll(step.Command)
+	step.Outputs = mapAll(step.Outputs)
+	step.ForbidOutputs = mapAll(step.ForbidOutputs)
+	step.Dir = fn(step.Dir)
+	step.Stdin = fn(step.Stdin)
+	step.Env = mapAllValues(step.Env)
+	step.LogFiles = mapAllValues(step.LogFiles)
+	return step
+}
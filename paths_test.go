@@ -0,0 +1,200 @@
+package chow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathRoots_Convert(t *testing.T) {
+	roots := pathRoots{
+		startDir: "/start",
+		cwd:      "/start/sub",
+		home:     "/home/user",
+		placeholder: func(id string) string {
+			return "/tmp/ph" + id
+		},
+	}
+
+	tests := []struct {
+		path      string
+		expected  string
+		converted bool
+	}{
+		{"//a/b.txt", "/start/a/b.txt", true},
+		{"//CWD/a/b.txt", "/start/sub/a/b.txt", true},
+		{"//ph/3", "/tmp/ph3", true},
+		{"//HOME/.config", "/home/user/.config", true},
+		{"//HOMEWORK/a.txt", "/start/HOMEWORK/a.txt", true},
+		{"//", "/start/", true},
+		{"//CWD/", "/start/sub/", true},
+		{"//CWD", "/start/CWD", true},
+		{"//CWDfile", "/start/CWDfile", true},
+		{"//phone/book.txt", "/start/phone/book.txt", true},
+		{"//start/CWD/a.txt", "/start/start/CWD/a.txt", true},
+		{"/abs/path", "/abs/path", false},
+		{"rel/path", "rel/path", false},
+		{"--flag", "--flag", false},
+	}
+	for _, test := range tests {
+		actual, converted := roots.convert(test.path)
+		if actual != test.expected || converted != test.converted {
+			t.Errorf("convert(%q): expected (%q, %v). Got (%q, %v)",
+				test.path, test.expected, test.converted, actual, converted)
+		}
+	}
+}
+
+func TestProdRunner_ConvertHome(t *testing.T) {
+	startDir, _ := os.Getwd()
+
+	t.Run("should resolve paths in the home directory", func(t *testing.T) {
+		runner := &prodRunner{
+			startDir:    startDir,
+			userHomeDir: func() (string, error) { return "/home/user", nil },
+		}
+		paths := []string{"//HOME/.config"}
+		if err := runner.convertAnyPaths(paths); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := filepath.FromSlash("/home/user/.config"); paths[0] != expected {
+			t.Errorf("expected %q. Got %q", expected, paths[0])
+		}
+	})
+
+	t.Run("should leave the path if the home directory is unknown", func(t *testing.T) {
+		runner := &prodRunner{
+			startDir:    startDir,
+			userHomeDir: func() (string, error) { return "", errors.New("$HOME is not defined") },
+		}
+		paths := []string{"//HOME/.config", "//a.txt"}
+		if err := runner.convertAnyPaths(paths); err != nil {
+			t.Fatal(err)
+		}
+
+		if paths[0] != "//HOME/.config" {
+			t.Errorf("expected %q. Got %q", "//HOME/.config", paths[0])
+		}
+		if expected := filepath.Join(startDir, "a.txt"); paths[1] != expected {
+			t.Errorf("expected %q. Got %q", expected, paths[1])
+		}
+	})
+}
+
+func TestTestRunner_ConvertPaths(t *testing.T) {
+	t.Run("should resolve paths like production with stubbed roots", func(t *testing.T) {
+		startDir, _ := os.Getwd()
+		placeholder := Placeholder("abc")
+		command := []string{"cat", "//a.txt", "//CWD/b.txt", "//HOME/c.txt", placeholder, "-v"}
+
+		runner := &testRunner{}
+		runner.Run("cat", Step{Command: command})
+
+		prodCommand := append([]string(nil), command...)
+		prod := &prodRunner{
+			startDir:    startDir,
+			userHomeDir: func() (string, error) { return "/home/user", nil },
+		}
+		if err := prod.convertAnyPaths(prodCommand); err != nil {
+			t.Fatal(err)
+		}
+
+		stub := strings.NewReplacer(
+			simulatedPath(placeholder), PlaceholderPath(placeholderID(placeholder)),
+			simulatedStartDir, startDir,
+			simulatedHome, "/home/user")
+		for i, arg := range runner.stepLogs[0].Step.Command {
+			if actual := filepath.FromSlash(stub.Replace(arg)); actual != prodCommand[i] {
+				t.Errorf("expected arg %d to be %q. Got %q", i, prodCommand[i], actual)
+			}
+		}
+	})
+
+	t.Run("should record paths against the simulated start dir", func(t *testing.T) {
+		runner := &testRunner{}
+		runner.Run("cp", Step{
+			Command: []string{"cp", "//a.txt", "//CWD/b.txt"},
+			Outputs: []string{"//CWD/b.txt"},
+		})
+
+		step := runner.stepLogs[0].Step
+		if step.Command[1] != "[START_DIR]/a.txt" || step.Command[2] != "[START_DIR]/b.txt" {
+			t.Errorf("expected paths rooted at the simulated start dir. Got %v", step.Command)
+		}
+		if !runner.exists("//CWD/b.txt") {
+			t.Errorf("expected //CWD/b.txt to be declared")
+		}
+	})
+}
+
+func TestAbs(t *testing.T) {
+	startDir, _ := os.Getwd()
+	home, homeErr := os.UserHomeDir()
+
+	tests := []struct {
+		path      string
+		prod      string
+		simulated string
+	}{
+		{"//a/b.txt", filepath.Join(startDir, "a", "b.txt"), "[START_DIR]/a/b.txt"},
+		{"//CWD/a.txt", filepath.Join(startDir, "a.txt"), "[START_DIR]/a.txt"},
+		{"//HOME/a.txt", filepath.Join(home, "a.txt"), "[HOME]/a.txt"},
+		{"a/b.txt", filepath.Join(startDir, "a", "b.txt"), "[START_DIR]/a/b.txt"},
+		{"/abs/a.txt", filepath.FromSlash("/abs/a.txt"), "/abs/a.txt"},
+	}
+
+	t.Run("should resolve paths in production", func(t *testing.T) {
+		for _, test := range tests {
+			if test.path == "//HOME/a.txt" && homeErr != nil {
+				continue
+			}
+			actual, err := Abs(test.path)
+			if err != nil {
+				t.Errorf("Abs(%q): expected no error. Got %v", test.path, err)
+			}
+			if actual != test.prod {
+				t.Errorf("Abs(%q): expected %q. Got %q", test.path, test.prod, actual)
+			}
+		}
+	})
+
+	t.Run("should resolve paths against the simulated roots in tests", func(t *testing.T) {
+		runTest(func(r Runner) {
+			for _, test := range tests {
+				actual, err := Abs(test.path)
+				if err != nil {
+					t.Errorf("Abs(%q): expected no error. Got %v", test.path, err)
+				}
+				if actual != test.simulated {
+					t.Errorf("Abs(%q): expected %q. Got %q", test.path, test.simulated, actual)
+				}
+			}
+		}, TestCase{})
+	})
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		root     string
+		elems    []string
+		expected string
+	}{
+		{"//", []string{"out", "a.txt"}, "//out/a.txt"},
+		{"//CWD/", []string{"out", "a.txt"}, "//CWD/out/a.txt"},
+		{"//HOME/", []string{".config"}, "//HOME/.config"},
+		{"//ph/", []string{"3"}, "//ph/3"},
+		{"//CWD/out", []string{"a.txt"}, "//CWD/out/a.txt"},
+		{"//CWD/out/", []string{"/a.txt"}, "//CWD/out/a.txt"},
+		{"//", []string{"a//b", "c.txt"}, "//a/b/c.txt"},
+		{"a//b", nil, "a/b"},
+		{"/abs", []string{"a.txt"}, "/abs/a.txt"},
+	}
+	for _, test := range tests {
+		if actual := Join(test.root, test.elems...); actual != test.expected {
+			t.Errorf("Join(%q, %q): expected %q. Got %q", test.root, test.elems, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package chow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RecipeStep is a named step in a recipe file.
+//
+// Its fields are those of Step, plus the name of the step.  For example:
+//
+//     {"name": "greet", "command": ["echo", "Hello"], "outputs": ["//CWD/out.txt"]}
+type RecipeStep struct {
+	Name string `json:"name" yaml:"name"`
+	Step `yaml:",inline"`
+}
+
+// RunFile runs the steps in the recipe file at path.
+//
+// A recipe file is a list of RecipeSteps, which are run in order as if by Main.  It is
+// parsed as YAML if its name ends in ".yaml" or ".yml", and as JSON otherwise.  This
+// allows recipes to be shared by applications that are not written in Go.
+//
+// An error is returned if the file cannot be read or parsed, or if a step fails.
+func RunFile(path string) error {
+	return runFile(path, os.Stdout, os.Stderr)
+}
+
+func runFile(path string, stdout, stderr io.Writer) error {
+	steps, err := readRecipe(path)
+	if err != nil {
+		return &ChowError{Err: err}
+	}
+
+	return runRunnable(runRecipe(steps), stdout, stderr, options{})
+}
+
+// Returns a Runnable that runs the given recipe steps in order.
+func runRecipe(steps []RecipeStep) Runnable {
+	return func(r Runner) {
+		for _, step := range steps {
+			r.Run(step.Name, step.Step)
+		}
+	}
+}
+
+// Reads the steps in the recipe file at path.
+func readRecipe(path string) ([]RecipeStep, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recipe: %v", err)
+	}
+
+	var steps []RecipeStep
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &steps)
+	default:
+		err = json.Unmarshal(contents, &steps)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recipe %s: %v", path, err)
+	}
+	return steps, nil
+}
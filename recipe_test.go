@@ -0,0 +1,103 @@
+package chow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRunFile(t *testing.T) {
+	echoPath := buildTestBinary(t, "echo")
+	defer os.RemoveAll(echoPath)
+
+	// Writes a recipe with the given contents to a temporary file with the extension ext,
+	// returning its path.
+	writeRecipe := func(t *testing.T, ext, contents string) string {
+		f, err := ioutil.TempFile("", "recipe*"+ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(contents); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+
+	t.Run("should run the steps in a recipe", func(t *testing.T) {
+		path := writeRecipe(t, ".json", fmt.Sprintf(`[
+			{"name": "first", "command": ["./%[1]s", "one"]},
+			{"name": "second", "command": ["./%[1]s", "two"]}
+		]`, echoPath))
+		defer os.Remove(path)
+
+		steps, err := readRecipe(path)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+
+		startDir, _ := os.Getwd()
+		var stepOutput bytes.Buffer
+		runRecipe(steps)(&prodRunner{
+			startDir:   startDir,
+			stdout:     new(bytes.Buffer),
+			stderr:     new(bytes.Buffer),
+			stepOutput: &stepOutput,
+		})
+
+		expected := []StepLog{{
+			StepName:   "first",
+			Step:       Step{Command: []string{"./" + echoPath, "one"}},
+			StepResult: StepResult{Stdout: "one"},
+		}, {
+			StepName:   "second",
+			Step:       Step{Command: []string{"./" + echoPath, "two"}},
+			StepResult: StepResult{Stdout: "two"},
+		}}
+		decoder := json.NewDecoder(&stepOutput)
+		for _, log := range expected {
+			var actual StepLog
+			if err := decoder.Decode(&actual); err != nil {
+				t.Fatalf("failed to decode step log: %v", err)
+			}
+			expectLogsEqual(t, log, actual)
+		}
+	})
+
+	t.Run("should read a YAML recipe", func(t *testing.T) {
+		path := writeRecipe(t, ".yaml", fmt.Sprintf(`
+- name: first
+  command: ["./%s", "one"]
+  outputs: ["//CWD/out.txt"]
+`, echoPath))
+		defer os.Remove(path)
+
+		steps, err := readRecipe(path)
+		if err != nil {
+			t.Fatalf("expected no error. Got %v", err)
+		}
+		expected := []RecipeStep{{
+			Name: "first",
+			Step: Step{
+				Command: []string{"./" + echoPath, "one"},
+				Outputs: []string{"//CWD/out.txt"},
+			},
+		}}
+		if !reflect.DeepEqual(expected, steps) {
+			t.Errorf("expected %v. Got %v", expected, steps)
+		}
+	})
+
+	t.Run("should error if the recipe cannot be parsed", func(t *testing.T) {
+		path := writeRecipe(t, ".json", "not json")
+		defer os.Remove(path)
+
+		if err := runFile(path, new(bytes.Buffer), new(bytes.Buffer)); err == nil {
+			t.Fatalf("expected an error. got nil")
+		}
+	})
+}
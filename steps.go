@@ -0,0 +1,63 @@
+package chow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TarCreate returns a step that creates the tar archive at archive from files, using the
+// platform's tar.
+//
+// The archive is gzip-compressed if its name ends in ".tar.gz" or ".tgz".  Paths may use
+// the framework's path syntax, and the archive is declared as the step's output.
+func TarCreate(archive string, files []string) Step {
+	flags := "-cf"
+	if strings.HasSuffix(archive, ".tar.gz") || strings.HasSuffix(archive, ".tgz") {
+		flags = "-czf"
+	}
+
+	return Step{
+		Command: append([]string{"tar", flags, archive}, files...),
+		Outputs: []string{archive},
+	}
+}
+
+// TarExtract returns a step that extracts the tar archive at archive into the directory
+// dest, using the platform's tar.
+//
+// dest must already exist; a DirectoryPlaceholder may be used as a scratch directory.
+// The archive may be compressed, in which case tar detects the compression.  Paths may
+// use the framework's path syntax, and dest is declared as the step's output.
+func TarExtract(archive, dest string) Step {
+	return Step{
+		Command: []string{"tar", "-xf", archive, "-C", dest},
+		Outputs: []string{dest},
+	}
+}
+
+// CIPDEnsure returns a step that installs CIPD packages into the directory root, using
+// "cipd ensure".
+//
+// packages maps the name of each package to its version, such as a tag or ref.  The
+// ensure file is written to a Placeholder, with one package per line in sorted order,
+// so that the step is deterministic.  Paths may use the framework's path syntax, and
+// root is declared as the step's output.
+func CIPDEnsure(root string, packages map[string]string) Step {
+	names := make([]string, 0, len(packages))
+	for name := range packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ensureFile strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&ensureFile, "%s %s\n", name, packages[name])
+	}
+
+	ensureFilePath := Placeholder(ensureFile.String())
+	return Step{
+		Command: []string{"cipd", "ensure", "-root", root, "-ensure-file", ensureFilePath},
+		Outputs: []string{root},
+	}
+}
@@ -0,0 +1,76 @@
+package chow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTarCreate(t *testing.T) {
+	tests := []struct {
+		archive  string
+		files    []string
+		expected Step
+	}{
+		{
+			archive: "//out/src.tar",
+			files:   []string{"//CWD/a.txt", "//CWD/b"},
+			expected: Step{
+				Command: []string{"tar", "-cf", "//out/src.tar", "//CWD/a.txt", "//CWD/b"},
+				Outputs: []string{"//out/src.tar"},
+			},
+		},
+		{
+			archive: "//out/src.tar.gz",
+			files:   []string{"//CWD/a.txt"},
+			expected: Step{
+				Command: []string{"tar", "-czf", "//out/src.tar.gz", "//CWD/a.txt"},
+				Outputs: []string{"//out/src.tar.gz"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if actual := TarCreate(test.archive, test.files); !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("expected %#v. Got %#v", test.expected, actual)
+		}
+	}
+}
+
+func TestTarExtract(t *testing.T) {
+	expected := Step{
+		Command: []string{"tar", "-xf", "//out/src.tgz", "-C", "//ph/0"},
+		Outputs: []string{"//ph/0"},
+	}
+	if actual := TarExtract("//out/src.tgz", "//ph/0"); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %#v. Got %#v", expected, actual)
+	}
+}
+
+func TestCIPDEnsure(t *testing.T) {
+	step := CIPDEnsure("//CWD/tools", map[string]string{
+		"fuchsia/go/${platform}":    "version:1.12",
+		"fuchsia/clang/${platform}": "git_revision:abc",
+	})
+
+	ensureFile := step.Command[len(step.Command)-1]
+	if !strings.HasPrefix(ensureFile, PathPlaceholder) {
+		t.Fatalf("expected the ensure file to be a placeholder. Got %q", ensureFile)
+	}
+	expected := Step{
+		Command: []string{"cipd", "ensure", "-root", "//CWD/tools", "-ensure-file", ensureFile},
+		Outputs: []string{"//CWD/tools"},
+	}
+	if !reflect.DeepEqual(expected, step) {
+		t.Errorf("expected %#v. Got %#v", expected, step)
+	}
+
+	contents, err := ReadPlaceholder(ensureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedContents := "fuchsia/clang/${platform} git_revision:abc\nfuchsia/go/${platform} version:1.12\n"
+	if contents != expectedContents {
+		t.Errorf("expected ensure file %q. Got %q", expectedContents, contents)
+	}
+}
@@ -0,0 +1,100 @@
+package chow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// RunSummary summarizes a run of a Runnable.
+//
+// Steps is the number of steps run, and Failures the number of those that exited with a
+// non-zero code, including tolerated failures.  Duration is the total duration of the
+// steps.  SlowestSteps lists up to five of the slowest steps, slowest first.
+//
+// Phases lists the phases started with Runner.Phase in the order they finished.
+// LogFiles holds the log files of each step that declared any, by step name and label.
+type RunSummary struct {
+	Steps        int                          `json:"steps"`
+	Failures     int                          `json:"failures"`
+	Duration     time.Duration                `json:"duration"`
+	SlowestSteps []StepSummary                `json:"slowest_steps,omitempty"`
+	Phases       []PhaseSummary               `json:"phases"`
+	LogFiles     map[string]map[string]string `json:"log_files,omitempty"`
+}
+
+// maxSlowestSteps is the number of steps listed in RunSummary.SlowestSteps.
+const maxSlowestSteps = 5
+
+// StepSummary describes a single step of a run.
+type StepSummary struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code"`
+}
+
+// PhaseSummary describes a single phase of a run.
+//
+// Duration is the sum of the durations of the steps run during the phase, including
+// those run by nested phases.
+type PhaseSummary struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Records the result of the named step.
+func (s *RunSummary) recordStep(name string, result StepResult) {
+	s.Steps++
+	s.Duration += result.Duration
+	if result.ExitCode != 0 {
+		s.Failures++
+	}
+
+	// Keep the slowest steps sorted, with earlier steps first among equals.
+	s.SlowestSteps = append(s.SlowestSteps, StepSummary{
+		Name:     name,
+		Duration: result.Duration,
+		ExitCode: result.ExitCode,
+	})
+	sort.SliceStable(s.SlowestSteps, func(i, j int) bool {
+		return s.SlowestSteps[i].Duration > s.SlowestSteps[j].Duration
+	})
+	if len(s.SlowestSteps) > maxSlowestSteps {
+		s.SlowestSteps = s.SlowestSteps[:maxSlowestSteps]
+	}
+}
+
+// Records the log files of the named step, if any.
+func (s *RunSummary) recordLogFiles(name string, logFiles map[string]string) {
+	if len(logFiles) == 0 {
+		return
+	}
+	if s.LogFiles == nil {
+		s.LogFiles = make(map[string]map[string]string)
+	}
+	s.LogFiles[name] = logFiles
+}
+
+// Runs fn as a phase of r and records the phase's duration.
+func (s *RunSummary) runPhase(r Runner, name string, fn func(Runner)) {
+	start := s.Duration
+	fn(&groupRunner{Runner: r, prefix: name + "/"})
+	s.Phases = append(s.Phases, PhaseSummary{
+		Name:     name,
+		Duration: s.Duration - start,
+	})
+}
+
+// Writes s as indented JSON to the file at path, replacing any existing file.
+func (s *RunSummary) writeFile(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run summary: %v", err)
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write run summary: %v", err)
+	}
+	return nil
+}
@@ -1,14 +1,22 @@
-// A simple cat program for testing.
+// A simple cat program for testing.  Reads from stdin if no files are given.
 package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 )
 
 func main() {
+	if len(os.Args) == 1 {
+		if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	for _, arg := range os.Args[1:] {
 		bytes, err := ioutil.ReadFile(arg)
 		if err != nil {
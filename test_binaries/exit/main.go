@@ -0,0 +1,24 @@
+// A program for testing that exits with the given code.  Any further arguments name
+// files to create before exiting, to simulate partially-written outputs.
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+func main() {
+	code, err := strconv.Atoi(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, arg := range os.Args[2:] {
+		file, err := os.Create(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+	}
+	os.Exit(code)
+}
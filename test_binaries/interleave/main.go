@@ -0,0 +1,18 @@
+// A program for testing that prints its arguments as lines alternating between stdout
+// and stderr.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	for i, arg := range os.Args[1:] {
+		if i%2 == 0 {
+			fmt.Fprintln(os.Stdout, arg)
+		} else {
+			fmt.Fprintln(os.Stderr, arg)
+		}
+	}
+}
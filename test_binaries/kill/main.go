@@ -0,0 +1,21 @@
+// A program for testing that kills itself.
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := process.Kill(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Wait to be killed.
+	time.Sleep(time.Minute)
+}
@@ -0,0 +1,16 @@
+// A simple sleep program for testing.
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	d, err := time.ParseDuration(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	time.Sleep(d)
+}
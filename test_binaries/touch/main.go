@@ -0,0 +1,17 @@
+// A simple touch program for testing.  Creates each file named in its arguments.
+package main
+
+import (
+	"log"
+	"os"
+)
+
+func main() {
+	for _, arg := range os.Args[1:] {
+		file, err := os.Create(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+	}
+}
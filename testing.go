@@ -1,19 +1,64 @@
 package chow
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
 )
 
 // Mock is used to mock a step invocation.
 //
 // Step specifies the name of the step to mock.  Return is the step result to return.
+// Creates lists the paths the mocked step creates, so that later steps and assertions
+// may use them.  Paths ending in "/" are directories, and a path inside a directory
+// implies that the directory exists.  Contents holds the contents of files the
+// mocked step writes, by path.  Modes holds the modes of files the mocked step creates,
+// by path, and is recorded in the step log.  These files are also considered created.
+//
+// The files in Result.Outputs are created like those in Contents, and are also written
+// to disk, with paths resolved against the process's working directory, so that the
+// recipe may read them.  They are removed, or their previous contents restored, when
+// the test finishes.  Only placeholders and files within the working directory are
+// written; outputs elsewhere, such as under //HOME/ or at absolute paths, are not.
+//
+// Command optionally restricts the mock to invocations of the step whose command is
+// exactly Command, as passed to Runner.Run.  This distinguishes invocations of a step
+// with different arguments.  When empty, the mock matches the step regardless of its
+// command.
+//
+// Matcher optionally restricts the mock to invocations of the step that match it, as
+// passed to Runner.Run.  Unless StrictZero is set, only the fields of Matcher that are
+// set are compared, and the rest match anything, so Step{Dir: "//out"} matches any step
+// run in "//out".  If StrictZero is set, the fields of Matcher that are not set must
+// also be unset in the step, so the whole step must equal Matcher.
+//
+// NamePattern optionally matches the step name against a regular expression, as
+// understood by the regexp package, instead of Step.  The pattern must match the whole
+// name, including the suffix of a repeated invocation, so "compile.*" matches
+// "compile", "compile 1" and so on.  Each invocation the pattern matches counts towards
+// Times.  It is a fatal error if the pattern is invalid.
+//
+// Times is the number of matching invocations the mock applies to before it is retired.
+// When zero, the mock applies to every matching invocation.  Repeated invocations of a
+// step are named "step_name 1", "step_name 2" and so on; a mock may name one of these to
+// apply to that invocation only, or the step's own name to apply to each invocation in
+// turn.
+//
 // Mocks should be installed from a TestBuilder, like so:
 //
 //     config.NewTest(func(b *TestBuilder) {
@@ -26,75 +71,753 @@ import (
 //        })
 //     })
 type Mock struct {
-	Step   string
-	Result StepResult
+	Step        string
+	NamePattern string
+	Command     []string
+	Matcher     Step
+	StrictZero  bool
+	Times       int
+	Result      StepResult
+	Creates     []string
+	Contents    map[string]string
+	Modes       map[string]os.FileMode
+
+	// Whether the mock has matched a step.
+	used bool
+}
+
+// Reports whether the mock applies to the named step.  base is the name the step was
+// run with, before it was made unique.
+func (m Mock) matches(name, base string, step Step) bool {
+	if m.NamePattern != "" {
+		re, err := regexp.Compile("^(?:" + m.NamePattern + ")$")
+		if err != nil {
+			logFatal("invalid mock name pattern", err, Step{})
+		}
+		if !re.MatchString(name) {
+			return false
+		}
+	} else if m.Step != name && m.Step != base {
+		return false
+	}
+	if len(m.Command) > 0 && !reflect.DeepEqual(m.Command, step.Command) {
+		return false
+	}
+	return m.matchesStep(step)
+}
+
+// Returns a description of the steps the mock matches, for error messages.
+func (m Mock) label() string {
+	if m.NamePattern != "" {
+		return fmt.Sprintf("pattern %q", m.NamePattern)
+	}
+	return fmt.Sprintf("%q", m.Step)
+}
+
+// Reports whether step matches the mock's Matcher.
+func (m Mock) matchesStep(step Step) bool {
+	if m.StrictZero {
+		return reflect.DeepEqual(m.Matcher, step)
+	}
+
+	// Overlay the matcher's set fields onto a copy of the step, so that the fields it
+	// leaves unset match anything.
+	expected := step
+	ev := reflect.ValueOf(&expected).Elem()
+	mv := reflect.ValueOf(m.Matcher)
+	for i := 0; i < mv.NumField(); i++ {
+		field := mv.Field(i)
+		if !reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+			ev.Field(i).Set(field)
+		}
+	}
+	return reflect.DeepEqual(expected, step)
 }
 
 // TestCase specifies how an application should be exected in testing.
 //
 // Name is the name of this test case, and will be embedded in the name of the expecation
-// file. Command-line flags can be set with `Args`.  The output of individual steps can
+// file. Command-line flags can be set with `Args`, which are parsed against
+// TestConfig.Flags before the application runs.  The output of individual steps can
 // be mocked via `Mocks`.   When two mocks match a given step, the one that was added the
-// added the earliest is used.  For debugging or streaming, you may substitute any
+// added the earliest is used, unless `StrictMocks` is set, in which case it is a fatal
+// error for more than one remaining mock to match a step.  It is an error for a mock to
+// match no step, since this usually means the step was renamed, unless
+// `AllowUnusedMocks` is set.  Steps that match no mock return `DefaultResult`, if
+// given, or an empty result otherwise.  For debugging or streaming, you may substitute any
 // io.Writer for `Output`.  If a value is given, no expectation file will be generated for
-// this test case.
+// this test case.  `ExpectWarnings` lists the warnings the application is expected to
+// issue, in any order.  When nil, warnings are not checked; use an empty slice to
+// require that no warnings are issued.  Step environments are omitted from the
+// expectation unless `RecordEnv` is set, in which case the stubbed environment given by
+// `Env` is recorded, merged with each step's own variables.
+//
+// Paths in expectations are resolved against a simulated start dir, "[START_DIR]", and
+// placeholders against a simulated directory, "[PLACEHOLDER]", so that expectations do
+// not depend on the machine they were generated on.
+//
+// `HashOutputs` records the digests of each step's outputs in the expectation, computed
+// from the contents given by mocks.
+//
+// `LogWriter`, if set, receives each step log as it is recorded, with its paths resolved
+// as in the expectation.
+//
+// `Env` stubs the environment of the process for steps with Step.ExpandEnv set, and for
+// recorded environments, so that they do not depend on the machine the test runs on.
+// The steps' own variables take precedence.
+//
+// `Properties` holds the application's properties, as returned by Runner.Properties.
+// It is marshaled to JSON, as if it were given by the -chow.properties flag, so it may be
+// a struct or a map.
+//
+// `Format` is the format the expectation is written in.  It defaults to JSON.
+//
+// `SuppressLogs` skips writing the expectation, for tests that only care about the
+// application's behavior, such as the warnings it issues.  Step logs are still recorded
+// in memory.
+//
+// `Platform` spoofs the operating system reported by Runner.Platform, using the same
+// values as runtime.GOOS.  When set, the expectation file is specific to the platform,
+// e.g. "name.windows.expected.json", since paths and commands often differ across
+// platforms.  If only the file shared by all platforms exists, the case is compared
+// against it instead, but updates still write the platform-specific file.  When empty,
+// the current platform is reported and the expectation file is shared by all platforms.
 type TestCase struct {
-	Name   string
-	Args   []string
-	Mocks  []Mock
-	Output io.Writer
+	Name             string
+	Args             []string
+	Mocks            []Mock
+	Output           io.Writer
+	ExpectWarnings   []string
+	RecordEnv        bool
+	Platform         string
+	HashOutputs      bool
+	DefaultResult    *StepResult
+	SuppressLogs     bool
+	LogWriter        LogWriter
+	Format           ExpectationFormat
+	Properties       interface{}
+	StrictMocks      bool
+	AllowUnusedMocks bool
+	Env              map[string]string
 }
 
 // TestConfig is used to run a test suite for an application.
 //
-// Runnable is the application's implementation.
+// Runnable is the application's implementation.  Whitespace controls how trailing
+// whitespace in step output is treated when comparing against an expectation.
+// ExpectationDir is the directory expectation files are read from and written to.  A
+// relative path is resolved against the current directory.  When empty, it is
+// "expectations".
+//
+// Flags holds the application's flags, as passed to Main.  Before each test case runs,
+// every flag is reset to its default value and then TestCase.Args are parsed against
+// it, so that test cases may exercise flag-dependent behavior.  The framework's own
+// flags are not registered; use the fields of TestCase instead.  It is an error for a
+// test case to have Args when Flags is nil.
 type TestConfig struct {
-	Runnable Runnable
+	Runnable       Runnable
+	Whitespace     WhitespacePolicy
+	ExpectationDir string
+	Flags          *flag.FlagSet
+}
+
+// WhitespacePolicy controls how trailing whitespace in a step's stdout, stderr and
+// combined output is compared against an expectation.
+//
+// Tools differ in whether they end their output with a newline, so by default trailing
+// whitespace is ignored.
+type WhitespacePolicy int
+
+const (
+	// TrimTrailingWhitespace ignores trailing whitespace when comparing output.
+	TrimTrailingWhitespace WhitespacePolicy = iota
+
+	// PreserveTrailingWhitespace requires output to match exactly.
+	PreserveTrailingWhitespace
+)
+
+// Reports whether the expected and actual step logs are equal under this policy.
+func (p WhitespacePolicy) equal(expected, actual []StepLog) bool {
+	return reflect.DeepEqual(p.normalize(expected), p.normalize(actual))
+}
+
+// Returns an error describing each difference between the expected and actual step
+// logs under this policy, or nil if they are equal.
+func (p WhitespacePolicy) compare(expected, actual []StepLog) error {
+	if p.equal(expected, actual) {
+		return nil
+	}
+
+	diffs := DiffStepLogs(p.normalize(expected), p.normalize(actual))
+	return fmt.Errorf("expectation differs:\n  %s", strings.Join(diffs, "\n  "))
+}
+
+// DiffStepLogs returns a readable description of each difference between the expected
+// and actual step logs, such as `step "build": -exit code: 0 -> 1`.  Steps are compared
+// in order, and the result is empty if the logs are equal.
+//
+// This is useful for building custom comparisons against expectations.
+func DiffStepLogs(expected, actual []StepLog) []string {
+	var diffs []string
+	if len(expected) != len(actual) {
+		diffs = append(diffs, fmt.Sprintf("-steps: %d -> %d", len(expected), len(actual)))
+	}
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			diffs = append(diffs, fmt.Sprintf("step %q: missing", expected[i].StepName))
+		case i >= len(expected):
+			diffs = append(diffs, fmt.Sprintf("step %q: unexpected", actual[i].StepName))
+		default:
+			diffs = append(diffs, diffStepLog(expected[i], actual[i])...)
+		}
+	}
+	return diffs
+}
+
+// Returns a description of each difference between the expected and actual step log.
+func diffStepLog(expected, actual StepLog) []string {
+	var diffs []string
+	check := func(field string, e, a interface{}) {
+		if !reflect.DeepEqual(e, a) {
+			diffs = append(diffs, fmt.Sprintf("step %q: -%s: %#v -> %#v",
+				expected.StepName, field, e, a))
+		}
+	}
+
+	check("name", expected.StepName, actual.StepName)
+
+	// Compare the fields of the step individually, named as in the expectation.
+	stepType := reflect.TypeOf(Step{})
+	expectedStep, actualStep := reflect.ValueOf(expected.Step), reflect.ValueOf(actual.Step)
+	for i := 0; i < stepType.NumField(); i++ {
+		name := strings.Split(stepType.Field(i).Tag.Get("json"), ",")[0]
+		check(strings.Replace(name, "_", " ", -1),
+			expectedStep.Field(i).Interface(), actualStep.Field(i).Interface())
+	}
+
+	check("stdout", expected.StepResult.Stdout, actual.StepResult.Stdout)
+	check("stderr", expected.StepResult.Stderr, actual.StepResult.Stderr)
+	check("combined", expected.StepResult.Combined, actual.StepResult.Combined)
+	check("exit code", expected.StepResult.ExitCode, actual.StepResult.ExitCode)
+	check("duration", expected.StepResult.Duration, actual.StepResult.Duration)
+
+	// Compare outputs individually, since they may be large.
+	keys := make(map[string]bool)
+	for key := range expected.StepResult.Outputs {
+		keys[key] = true
+	}
+	for key := range actual.StepResult.Outputs {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		e, eok := expected.StepResult.Outputs[key]
+		a, aok := actual.StepResult.Outputs[key]
+		switch {
+		case !aok:
+			diffs = append(diffs, fmt.Sprintf("step %q: missing output %q", expected.StepName, key))
+		case !eok:
+			diffs = append(diffs, fmt.Sprintf("step %q: unexpected output %q", expected.StepName, key))
+		default:
+			check(fmt.Sprintf("output %q", key), e, a)
+		}
+	}
+
+	check("recorded env", expected.Env, actual.Env)
+	check("recorded stdin", expected.Stdin, actual.Stdin)
+	check("output digests", expected.OutputDigests, actual.OutputDigests)
+	check("output modes", expected.OutputModes, actual.OutputModes)
+	return diffs
+}
+
+// Returns a copy of logs with step output normalized according to this policy.
+func (p WhitespacePolicy) normalize(logs []StepLog) []StepLog {
+	normalized := make([]StepLog, len(logs))
+	copy(normalized, logs)
+	if p == PreserveTrailingWhitespace {
+		return normalized
+	}
+
+	for i := range normalized {
+		result := &normalized[i].StepResult
+		result.Stdout = strings.TrimRightFunc(result.Stdout, unicode.IsSpace)
+		result.Stderr = strings.TrimRightFunc(result.Stderr, unicode.IsSpace)
+		result.Combined = strings.TrimRightFunc(result.Combined, unicode.IsSpace)
+	}
+	return normalized
+}
+
+// Whether TestConfig.Run should rewrite expectation files that differ from the
+// application's behavior, rather than failing.  The -chow.update flag is only registered
+// in test binaries, so that importing the package does not add a flag to applications.
+// It is nil otherwise.
+var updateFlag *bool
+
+// The environment variable that, when non-empty, has the same effect as -chow.update.
+const updateEnvVar = "CHOW_UPDATE"
+
+func init() {
+	if isTestBinary() {
+		updateFlag = flag.Bool("chow.update", false,
+			"Rewrite expectation files that differ from the application's behavior")
+	}
+}
+
+// Reports whether the process is a test binary built by "go test".
+func isTestBinary() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return strings.HasSuffix(name, ".test")
+}
+
+// Reports whether TestConfig.Run should rewrite expectation files.
+func updateExpectations() bool {
+	return updateFlag != nil && *updateFlag || os.Getenv(updateEnvVar) != ""
+}
+
+// Run runs the application for the given test case and checks it against its
+// expectation.
+//
+// If the expectation file exists, the application's step logs are compared against it,
+// and an error describing the differences is returned if they differ.  If the file does
+// not exist, or the -chow.update flag or CHOW_UPDATE environment variable is set, the file
+// is written instead.  If
+// TestCase.Output is set, the expectation is written to it and not compared.
+//
+// An error is returned if the test case has no name, if the expectation cannot be read
+// or written, or if the application did not behave as the test case expects.  This
+// includes fatal errors raised by the run, such as a step that matches more than one
+// mock under TestCase.StrictMocks, which are returned as a *ChowError.
+func (c *TestConfig) Run(tc TestCase) error {
+	if tc.Name == "" {
+		return errors.New("test case name cannot be empty")
+	}
+
+	if err := c.parseArgs(tc.Args); err != nil {
+		return err
+	}
+
+	runner, err := tryRunTest(c.Runnable, tc)
+	if err != nil {
+		return err
+	}
+
+	if tc.ExpectWarnings != nil {
+		if err := compareWarnings(tc.ExpectWarnings, runner.warnings); err != nil {
+			return err
+		}
+	}
+
+	if !tc.AllowUnusedMocks {
+		if err := checkUnusedMocks(runner.Mocks); err != nil {
+			return err
+		}
+	}
+
+	if tc.SuppressLogs {
+		return nil
+	}
+	if tc.Output != nil {
+		return tc.Format.encode(tc.Output, runner.stepLogs)
+	}
+
+	path, err := expectationPath(c.ExpectationDir, tc.Name, tc.Platform, tc.Format)
+	if err != nil {
+		return err
+	}
+	// Updates always write the platform-specific expectation, so that updating one
+	// platform's expectation does not change those of the platforms sharing a file.
+	if !updateExpectations() {
+		if existing, ok := findExpectation(filepath.Dir(path), tc.Name, tc.Platform, tc.Format); ok {
+			path = existing
+		}
+	}
+	return c.checkExpectation(path, runner.stepLogs, tc.Format)
+}
+
+// Resets the config's flags to their defaults and parses args against them.
+func (c *TestConfig) parseArgs(args []string) error {
+	if c.Flags == nil {
+		if len(args) > 0 {
+			return errors.New("test case has args, but the config has no flags")
+		}
+		return nil
+	}
+
+	var err error
+	c.Flags.VisitAll(func(f *flag.Flag) {
+		if setErr := f.Value.Set(f.DefValue); setErr != nil && err == nil {
+			err = fmt.Errorf("failed to reset flag %q: %v", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Report parse errors to the caller rather than exiting, and restore the caller's
+	// error handling afterwards.
+	defer c.Flags.Init(c.Flags.Name(), c.Flags.ErrorHandling())
+	c.Flags.Init(c.Flags.Name(), flag.ContinueOnError)
+	if err := c.Flags.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse args: %v", err)
+	}
+	return nil
 }
 
-// Run implements Runner.
-func (c *TestConfig) Run(t *testing.T, tc TestCase) {
-	if t.Name() == "" {
-		panic(errors.New("test case name cannot be empty"))
+// Compares logs against the expectation file at path, or writes them to the file if it
+// does not exist or -chow.update is set.
+func (c *TestConfig) checkExpectation(path string, logs []StepLog, format ExpectationFormat) error {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || updateExpectations() {
+		return writeExpectationFile(path, logs, format)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	expected, err := format.decode(contents)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	// Round-trip the logs through the format, so that they compare equal to the
+	// expectation they would produce.
+	var b bytes.Buffer
+	if err := format.encode(&b, logs); err != nil {
+		return err
+	}
+	actual, err := format.decode(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal expectation: %v", err)
+	}
+
+	if err := c.Whitespace.compare(expected, actual); err != nil {
+		return fmt.Errorf("%s: %v\nRun with -chow.update to update the expectation", path, err)
 	}
+	return nil
+}
 
-	if tc.Output == nil {
-		tc.Output = createExpectationFile(t)
+// Writes logs to the expectation file at path, replacing any existing file.
+func writeExpectationFile(path string, logs []StepLog, format ExpectationFormat) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", path, err)
 	}
+	defer file.Close()
+	return format.encode(file, logs)
+}
 
-	runner := &testRunner{Mocks: tc.Mocks}
-	c.Runnable(runner)
+// Runs r in test mode and returns the runner used.
+func runTest(r Runnable, tc TestCase) *testRunner {
+	var properties []byte
+	if tc.Properties != nil {
+		var err error
+		if properties, err = json.Marshal(tc.Properties); err != nil {
+			logFatal("failed to marshal properties", err, Step{})
+		}
+	}
 
-	encoder := json.NewEncoder(tc.Output)
+	// Copy the mocks, since the runner consumes them as they match.
+	runner := &testRunner{
+		Mocks:         append([]Mock(nil), tc.Mocks...),
+		recordEnv:     tc.RecordEnv,
+		platform:      tc.Platform,
+		hashOutputs:   tc.HashOutputs,
+		defaultResult: tc.DefaultResult,
+		logWriter:     tc.LogWriter,
+		properties:    string(properties),
+		strictMocks:   tc.StrictMocks,
+		env:           tc.Env,
+	}
+	// Number the application's placeholders from the same ID on every run, so that
+	// expectations do not depend on the tests that ran before.
+	defer rollBackPlaceholders(atomic.LoadInt64(&placeholderCount))
+	defer setActiveRunner(runner)()
+	defer func() {
+		if err := runner.cleanup(); err != nil {
+			logWarning(err.Error(), Step{})
+		}
+	}()
+	r(runner)
+	return runner
+}
+
+// Like runTest, but returns any fatal error raised by the run rather than panicking.
+func tryRunTest(r Runnable, tc TestCase) (runner *testRunner, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			chowErr, ok := r.(*ChowError)
+			if !ok {
+				panic(r)
+			}
+			err = chowErr
+		}
+	}()
+	return runTest(r, tc), nil
+}
+
+// ExpectationFormat is the format expectations are written in.
+type ExpectationFormat int
+
+const (
+	// FormatJSON writes expectations as indented JSON, to files named
+	// "<name>.expected.json".  This is the default.
+	FormatJSON ExpectationFormat = iota
+
+	// FormatYAML writes expectations as YAML, to files named "<name>.expected.yaml".
+	FormatYAML
+)
+
+// Returns the extension of expectation files in this format.
+func (f ExpectationFormat) extension() string {
+	if f == FormatYAML {
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// Writes logs to w as an expectation in this format.
+func (f ExpectationFormat) encode(w io.Writer, logs []StepLog) error {
+	if f != FormatYAML {
+		return encodeExpectation(w, logs)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	if err := encoder.Encode(logs); err != nil {
+		return fmt.Errorf("failed to marshal expectation: %v", err)
+	}
+	return encoder.Close()
+}
+
+// Returns the step logs in an expectation in this format.
+func (f ExpectationFormat) decode(contents []byte) ([]StepLog, error) {
+	var logs []StepLog
+	var err error
+	if f == FormatYAML {
+		err = yaml.Unmarshal(contents, &logs)
+	} else {
+		err = json.Unmarshal(contents, &logs)
+	}
+	return logs, err
+}
+
+// Writes logs to w as a JSON expectation.
+func encodeExpectation(w io.Writer, logs []StepLog) error {
+	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(runner.stepLogs); err != nil {
-		panic(fmt.Errorf("failed to marshal expectation: %v", err))
+	if err := encoder.Encode(logs); err != nil {
+		return fmt.Errorf("failed to marshal expectation: %v", err)
 	}
+	return nil
 }
 
-// TODO: Fix panics in this function.
-func createExpectationFile(t *testing.T) *os.File {
-	// Generate test directory if it doesn't exist.
-	cwd, err := os.Getwd()
+// ValidateExpectation reports whether r holds a well-formed expectation.
+//
+// The expectation is decoded strictly, so that unknown fields and values of the wrong
+// type are errors.  The error describes the first problem found, and the line it was
+// found on where possible.  This allows committed expectations to be validated, for
+// example in continuous integration.
+func ValidateExpectation(r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
 	if err != nil {
-		panic(fmt.Errorf("could not get current directory: %v", err))
+		return fmt.Errorf("failed to read expectation: %v", err)
 	}
 
-	// Generate output directory.
-	outDir := filepath.Join(cwd, "expectations")
-	if err := os.MkdirAll(outDir, os.FileMode(os.O_APPEND)); err != nil {
-		panic(fmt.Errorf("could not create %s: %v", outDir, err))
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	var logs []StepLog
+	if err := decoder.Decode(&logs); err != nil {
+		if line := errorLine(contents, err); line > 0 {
+			return fmt.Errorf("invalid expectation on line %d: %v", line, err)
+		}
+		return fmt.Errorf("invalid expectation: %v", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid expectation: unexpected data after the step logs")
+	}
+	return nil
+}
+
+// Returns the line of contents on which the JSON decoding error err occurred, or 0 if
+// it is unknown.
+func errorLine(contents []byte, err error) int {
+	offset := -1
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = int(err.Offset)
+	case *json.UnmarshalTypeError:
+		offset = int(err.Offset)
+	default:
+		// Errors for unknown fields have no offset, so find the field instead.
+		const prefix = "json: unknown field "
+		if strings.HasPrefix(err.Error(), prefix) {
+			offset = bytes.Index(contents, []byte(strings.TrimPrefix(err.Error(), prefix)))
+		}
+	}
+	if offset < 0 || offset > len(contents) {
+		return 0
+	}
+	return bytes.Count(contents[:offset], []byte("\n")) + 1
+}
+
+// Returns an error listing the mocks that never matched a step, if any.
+func checkUnusedMocks(mocks []Mock) error {
+	var unused []string
+	for _, mock := range mocks {
+		if !mock.used {
+			unused = append(unused, mock.label())
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+	return fmt.Errorf("mocks matched no step: %s", strings.Join(unused, ", "))
+}
+
+// Returns an error listing any warnings that were expected but not issued, or issued
+// but not expected.
+func compareWarnings(expected, actual []string) error {
+	counts := make(map[string]int)
+	for _, warning := range expected {
+		counts[warning]++
+	}
+	for _, warning := range actual {
+		counts[warning]--
+	}
+
+	var missing, unexpected []string
+	for _, warning := range expected {
+		if counts[warning] > 0 {
+			missing = append(missing, warning)
+			counts[warning]--
+		}
+	}
+	for _, warning := range actual {
+		if counts[warning] < 0 {
+			unexpected = append(unexpected, warning)
+			counts[warning]++
+		}
+	}
+
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+	return fmt.Errorf("warnings differ from expected: missing %q, unexpected %q",
+		missing, unexpected)
+}
+
+// CreateExpectationFile creates the expectation file for the running test.
+//
+// The file is created at expectations/<TestName>.expected.json, relative to the current
+// directory, where "/" in the test name is replaced by ".", and other characters that
+// are invalid in filenames by "_".  Applications may use this to supply their own
+// expectation writer to TestCase.Output.
+func CreateExpectationFile(t *testing.T) (*os.File, error) {
+	return createExpectationFile(t.Name(), "")
+}
+
+// Creates the expectation file for the named test case.  If platform is not empty, the
+// file is specific to that platform.
+func createExpectationFile(name, platform string) (*os.File, error) {
+	outPath, err := expectationPath("", name, platform, FormatJSON)
+	if err != nil {
+		return nil, err
 	}
 
 	// Generate output file.
-	basename := strings.Replace(t.Name(), "/", ".", -1) + ".expected.json"
-	outPath := filepath.Join(outDir, basename)
 	outFile, err := os.Create(outPath)
 	if err != nil {
-		panic(fmt.Errorf("could not create %s: %v", outPath, err))
+		return nil, fmt.Errorf("could not create %s: %v", outPath, err)
 	}
 
-	return outFile
+	return outFile, nil
+}
+
+// Returns the path of the expectation file in the given format for the named test case
+// in dir, creating dir if it doesn't exist.  If dir is empty, the default directory is
+// used.
+func expectationPath(dir, name, platform string, format ExpectationFormat) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("could not get current directory: %v", err)
+	}
+
+	// Generate output directory.
+	if dir == "" {
+		dir = defaultExpectationDir
+	}
+	outDir := dir
+	if !filepath.IsAbs(outDir) {
+		outDir = filepath.Join(cwd, dir)
+	}
+	if err := os.MkdirAll(outDir, expectationDirMode); err != nil {
+		return "", fmt.Errorf("could not create %s: %v", outDir, err)
+	}
+
+	return filepath.Join(outDir, expectationBasename(name, platform, format)), nil
+}
+
+// The directory expectation files are written to, relative to the current directory,
+// unless TestConfig.ExpectationDir is set.
+const defaultExpectationDir = "expectations"
+
+// The mode of expectation directories created by the framework, before the umask.
+const expectationDirMode os.FileMode = 0755
+
+// Returns the basename of the expectation file in the given format for the named test
+// case.  If platform is not empty, the name is suffixed with the platform, e.g.
+// "name.linux.expected.json".
+func expectationBasename(name, platform string, format ExpectationFormat) string {
+	basename := sanitizeFilename(name)
+	if platform != "" {
+		basename += "." + platform
+	}
+	return basename + ".expected" + format.extension()
+}
+
+// Returns name with any characters that are invalid in a filename on Linux, macOS or
+// Windows replaced.  Path separators become ".", as in subtest names, and other invalid
+// characters and whitespace become "_".  Runs of replacements are collapsed, and they
+// are trimmed from either end.
+func sanitizeFilename(name string) string {
+	var b strings.Builder
+	var last rune
+	for _, c := range name {
+		switch {
+		case c == '/' || c == '\\':
+			c = '.'
+		case strings.ContainsRune(`<>:"|?*`, c) || unicode.IsSpace(c) || unicode.IsControl(c):
+			c = '_'
+		}
+		if (c == '.' || c == '_') && c == last {
+			continue
+		}
+		b.WriteRune(c)
+		last = c
+	}
+	return strings.Trim(b.String(), "._")
+}
+
+// Returns the path of the expectation file in the given format in dir for the named test
+// case on the given platform.  The platform-specific file is preferred, falling back to
+// the file shared by all platforms.  Reports false if neither exists.
+func findExpectation(dir, name, platform string, format ExpectationFormat) (string, bool) {
+	candidates := []string{expectationBasename(name, "", format)}
+	if platform != "" {
+		candidates = append([]string{expectationBasename(name, platform, format)}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
 }
 
 // Skips a test when running on CI, since we can't do file I/O.